@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+// The scope /fulfillment requires in an access token. Google doesn't have to
+// ask for it, tokens issued to a client which asked for no scope at all get it.
+// It is the only scope there is, /authorize and /token refuse requests for any
+// other, see validScope.
+const fulfillmentScope = "smarthome"
+
+// How far the clocks of two instances may disagree when checking nbf and exp.
+const clockSkew = time.Minute
+
+// The claims of our access tokens. Audience is the OAuth client the token was
+// issued to, Subject the user, and Scope the space separated scopes granted.
+type AccessClaims struct {
+	jwt.StandardClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+// Called by jwt.ParseWithClaims once the signature has been checked. Unlike
+// jwt.StandardClaims, a token without an expiry is not valid.
+func (c *AccessClaims) Valid() error {
+	now := time.Now()
+	if c.ExpiresAt == 0 {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-clockSkew).Unix() > c.ExpiresAt {
+		return fmt.Errorf("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Unix() < c.NotBefore {
+		return fmt.Errorf("token not valid yet")
+	}
+	return nil
+}
+
+func (c *AccessClaims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the token may be used for /fulfillment. Tokens issued before we added
+// the iat and scope claims have neither, and were all meant for fulfillment.
+func (c *AccessClaims) AllowsFulfillment() bool {
+	if c.Scope == "" && c.IssuedAt == 0 {
+		return true
+	}
+	return c.HasScope(fulfillmentScope)
+}
+
+// Whether a client may ask for the space separated scopes, if any, in the scope
+// parameter of /authorize or /token. Refusing others there makes a mistake in
+// the account linking settings fail while linking, rather than every request
+// for fulfillment afterwards.
+func validScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s != fulfillmentScope {
+			return false
+		}
+	}
+	return true
+}
+
+// The time the token was issued. Tokens issued before we set "iat" lived for
+// accessTokenExp, so for those it follows from their expiry.
+func (c *AccessClaims) IssuedAtTime() time.Time {
+	if c.IssuedAt != 0 {
+		return time.Unix(c.IssuedAt, 0)
+	}
+	return time.Unix(c.ExpiresAt, 0).Add(-accessTokenExp)
+}
+
+// Parse an access token we issued, checking its signature, expiry and nbf.
+func parseAccessToken(access string) (*AccessClaims, bool) {
+	token, err := jwt.ParseWithClaims(access, &AccessClaims{}, jwtKeys.Keyfunc)
+	if err != nil {
+		return nil, false
+	}
+	claims, ok := token.Claims.(*AccessClaims)
+	if !ok || !token.Valid {
+		return nil, false
+	}
+	return claims, true
+}
+
+// Issues our access tokens, replacing generates.JWTAccessGenerate so that they
+// carry iat, nbf and scope claims alongside the audience, subject and expiry.
+type AccessGenerate struct {
+	keys *JWTKeys
+}
+
+func NewAccessGenerate(keys *JWTKeys) *AccessGenerate {
+	return &AccessGenerate{keys: keys}
+}
+
+func (a *AccessGenerate) Token(ctx context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	createAt := data.TokenInfo.GetAccessCreateAt()
+	scope := data.TokenInfo.GetScope()
+	if scope == "" {
+		scope = fulfillmentScope
+	}
+	claims := &AccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  data.Client.GetID(),
+			Subject:   data.UserID,
+			IssuedAt:  createAt.Unix(),
+			NotBefore: createAt.Unix(),
+			ExpiresAt: createAt.Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
+		},
+		Scope: scope,
+	}
+
+	token := jwt.NewWithClaims(a.keys.SigningMethod, claims)
+	if a.keys.SigningKID != "" {
+		token.Header["kid"] = a.keys.SigningKID
+	}
+	access, err := token.SignedString(a.keys.signingKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh := ""
+	if isGenRefresh {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+		refresh = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return access, refresh, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Sign access tokens with an HMAC key and accept them for client "google".
+func setupTestTokens(t *testing.T) {
+	t.Helper()
+	settings = &Config{JWTKey: "test key"}
+	var err error
+	jwtKeys, err = LoadJWTKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations, err = OpenRevocationList("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauthClientId = "google"
+}
+
+func signTestToken(t *testing.T, claims *AccessClaims) string {
+	t.Helper()
+	access, err := jwt.NewWithClaims(jwtKeys.SigningMethod, claims).SignedString(jwtKeys.signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return access
+}
+
+func TestValidateJWTScope(t *testing.T) {
+	setupTestTokens(t)
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		claims AccessClaims
+		ok     bool
+	}{
+		{"current token", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			IssuedAt: now.Unix(), ExpiresAt: exp}, "smarthome"}, true},
+		{"several scopes", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			IssuedAt: now.Unix(), ExpiresAt: exp}, "other smarthome"}, true},
+		// issued before the iat and scope claims, still linked
+		{"legacy token", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			ExpiresAt: exp}, ""}, true},
+		{"other scope", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			IssuedAt: now.Unix(), ExpiresAt: exp}, "other"}, false},
+		{"no scope but iat", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			IssuedAt: now.Unix(), ExpiresAt: exp}, ""}, false},
+		{"other client", AccessClaims{jwt.StandardClaims{Audience: "other", Subject: "alice",
+			IssuedAt: now.Unix(), ExpiresAt: exp}, "smarthome"}, false},
+		{"expired", AccessClaims{jwt.StandardClaims{Audience: "google", Subject: "alice",
+			IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()}, "smarthome"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := tt.claims
+			r := httptest.NewRequest("POST", "/fulfillment", nil)
+			r.Header.Set("Authorization", "Bearer "+signTestToken(t, &claims))
+			got, reason := ValidateJWT(r)
+			if (got != nil) != tt.ok {
+				t.Errorf("ValidateJWT = %v %q, want ok %v", got, reason, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"", true},
+		{"smarthome", true},
+		{" smarthome  smarthome ", true},
+		{"openid", false},
+		{"smarthome email", false},
+	}
+	for _, tt := range tests {
+		if got := validScope(tt.scope); got != tt.want {
+			t.Errorf("validScope(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
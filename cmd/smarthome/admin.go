@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// Wrap a handler for administrative actions, which need the bearer token in
+// ADMIN_TOKEN or to come from an address in ADMIN_ALLOWED_IPS, a comma separated
+// list of addresses and prefixes like "100.64.0.0/10,192.168.1.5". The address
+// is that of the connection: behind a proxy like Cloud Run's it is the proxy's,
+// so there only the token will do. With neither set, they are disabled entirely.
+func RequireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func isAdmin(r *http.Request) bool {
+	want := settings.AdminToken
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+		return true
+	}
+
+	allowed := settings.AdminAllowedIPs
+	if allowed == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, s := range strings.Split(allowed, ",") {
+		s = strings.TrimSpace(s)
+		if prefix, err := netaddr.ParseIPPrefix(s); err == nil {
+			if prefix.Contains(ip) {
+				return true
+			}
+		} else if allowedIP, err := netaddr.ParseIP(s); err == nil {
+			if allowedIP.Unmap() == ip {
+				return true
+			}
+		} else {
+			log.Printf("ADMIN_ALLOWED_IPS: cannot parse %q\n", s)
+		}
+	}
+	return false
+}
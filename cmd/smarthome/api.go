@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// JSON API for tooling, behind RequireAdmin:
+//
+//	GET  /api/homes                                 users of the homes
+//	GET  /api/homes/<user>/devices                  all devices with their state
+//	GET  /api/homes/<user>/devices/<id>             one device
+//	POST /api/homes/<user>/devices/<id>/command     {"command":"Dimmer","payload":"50"}
+//	POST /api/homes/<user>/devices/<id>/query       ask the device for its state
+//	GET  /api/homes/<user>/devices/<id>/config      the DeviceConfig
+//	PUT  /api/homes/<user>/devices/<id>/config      replace it, {} removes it
+//	POST /api/homes/<user>/sync                     have Google send a SYNC
+//
+// Devices are identified by their MAC address, as in the devices of a home.
+// Errors are {"error":"..."} with an HTTP status.
+func HandleAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	if len(path) == 1 && path[0] == "homes" {
+		requireMethod(w, r, http.MethodGet, handleAPIHomes)
+		return
+	}
+	if len(path) < 3 || path[0] != "homes" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	home, ok := homes[path[1]]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no such home")
+		return
+	}
+
+	switch {
+	case len(path) == 3 && path[2] == "sync":
+		requireMethod(w, r, http.MethodPost, home.handleAPISync)
+	case len(path) == 3 && path[2] == "devices":
+		requireMethod(w, r, http.MethodGet, home.handleAPIDevices)
+	case len(path) == 4 && path[2] == "devices":
+		requireMethod(w, r, http.MethodGet, home.handleAPIDevice(path[3]))
+	case len(path) == 5 && path[2] == "devices" && path[4] == "command":
+		requireMethod(w, r, http.MethodPost, home.handleAPICommand(path[3]))
+	case len(path) == 5 && path[2] == "devices" && path[4] == "query":
+		requireMethod(w, r, http.MethodPost, home.handleAPIQuery(path[3]))
+	case len(path) == 5 && path[2] == "devices" && path[4] == "config":
+		home.handleAPIConfig(path[3])(w, r)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string, handler http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, method+" required")
+		return
+	}
+	handler(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// A device as the API shows it: what discovery found, its last known state, its
+// settings and what Google is told about it in SYNC.
+type APIDevice struct {
+	Id         string                     `json:"id"`
+	Name       string                     `json:"name"`
+	Topic      string                     `json:"topic"`
+	IP         string                     `json:"ip"`
+	Hostname   string                     `json:"hostname"`
+	Hardware   string                     `json:"hardware"`
+	Software   string                     `json:"software"`
+	PowerState string                     `json:"powerState,omitempty"`
+	FanSpeed   *int                       `json:"fanSpeed,omitempty"` // iFans only
+	Thermostat *APIThermostat             `json:"thermostat,omitempty"`
+	IsLocked   *bool                      `json:"isLocked,omitempty"` // locks only
+	Switches   map[string]string          `json:"switches,omitempty"`
+	Timer      *APITimer                  `json:"timer,omitempty"`
+	Config     DeviceConfig               `json:"config"` // without the pin
+	Google     []IntentSyncResponseDevice `json:"google"` // two for an iFan
+}
+
+type APIThermostat struct {
+	Mode    string  `json:"mode"`
+	Target  float64 `json:"target"`
+	Ambient float64 `json:"ambient"`
+}
+
+type APITimer struct {
+	RemainingSec int  `json:"remainingSec"`
+	Paused       bool `json:"paused"`
+}
+
+// The API view of a device, with the device lock held.
+func (home *Home) apiDevice(d TasmotaDevice) APIDevice {
+	device := APIDevice{
+		Id:         d.MacAddress,
+		Name:       d.Name(),
+		Topic:      d.TopicName,
+		IP:         d.IP,
+		Hostname:   d.Hostname,
+		Hardware:   d.Hardware,
+		Software:   d.Software,
+		PowerState: d.PowerState,
+		Switches:   make(map[string]string),
+		Config:     d.Config(),
+		Google:     []IntentSyncResponseDevice{d.ToIntentSyncResponseDevice()},
+	}
+	device.Config.Pin = ""
+	for k, v := range d.Switches {
+		// copied, MQTT messages update them after the device lock is released
+		device.Switches[k] = v
+	}
+	if d.IsFan {
+		speed := d.FanSpeed
+		device.FanSpeed = &speed
+		device.Google = append(device.Google, d.ToIntentSyncResponseLight())
+	}
+	if d.IsThermostat() {
+		device.Thermostat = &APIThermostat{
+			Mode:    thermostatModeName(d.ThermostatMode),
+			Target:  d.TempTarget,
+			Ambient: d.TempAmbient,
+		}
+	}
+	if d.IsLock() {
+		device.IsLocked = isLockedState(d.IsLocked())
+	}
+	if sec, paused := home.timerState(d.MacAddress); sec >= 0 {
+		device.Timer = &APITimer{RemainingSec: sec, Paused: paused}
+	}
+	return device
+}
+
+func handleAPIHomes(w http.ResponseWriter, r *http.Request) {
+	users := make([]string, 0, len(homes))
+	for user := range homes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (home *Home) handleAPIDevices(w http.ResponseWriter, r *http.Request) {
+	home.deviceLock.Lock()
+	devices := make([]APIDevice, 0, len(home.devices))
+	for _, d := range home.devices {
+		devices = append(devices, home.apiDevice(d))
+	}
+	home.deviceLock.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Id < devices[j].Id })
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (home *Home) handleAPIDevice(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		home.deviceLock.Lock()
+		d, ok := home.devices[id]
+		var device APIDevice
+		if ok {
+			device = home.apiDevice(d)
+		}
+		home.deviceLock.Unlock()
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "no such device")
+			return
+		}
+		writeJSON(w, http.StatusOK, device)
+	}
+}
+
+// Publish a Tasmota command to the device. Its reply isn't waited for, the state
+// it reports shows up in the device later. This is for the admin only, and on
+// purpose skips the challenges Google is made to ask for: it can switch a lock
+// without its PIN. Only single commands are taken, not Backlog or the rules and
+// scripts which run commands of their own.
+func (home *Home) handleAPICommand(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var command SceneCommand
+		if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "cannot decode command: "+err.Error())
+			return
+		}
+		if command.Command == "" || strings.ContainsAny(command.Command, "/+# \t") {
+			writeAPIError(w, http.StatusBadRequest, "invalid command")
+			return
+		}
+		if isMultiCommand(command.Command) {
+			writeAPIError(w, http.StatusBadRequest, "only single commands are allowed")
+			return
+		}
+
+		if !home.waitReady(r.Context(), readyTimeout) {
+			writeAPIError(w, http.StatusServiceUnavailable, "devices not discovered yet")
+			return
+		}
+		home.deviceLock.Lock()
+		d, ok := home.devices[id]
+		home.deviceLock.Unlock()
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "no such device")
+			return
+		}
+
+		ctx, span := StartServerSpan(r, "api.command", "device", id, "command", command.Command)
+		defer span.Finish()
+		err := home.SendCommand(ctx, d.TopicName, command.Command, command.Payload)
+		if err != nil {
+			logger.Warn("API command failed", "user", home.User, "device", id, "error", err)
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		logger.Info("API command", "user", home.User, "device", id, "command", command.Command)
+		writeJSON(w, http.StatusAccepted, map[string]string{"topic": "cmnd/" + d.TopicName + "/" + command.Command})
+	}
+}
+
+// Whether a Tasmota command runs other commands: Backlog and Backlog0, and the
+// Rule and Script commands setting up what runs on events.
+func isMultiCommand(command string) bool {
+	c := strings.ToLower(command)
+	for _, prefix := range []string{"backlog", "rule", "script"} {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask the device for its state like a QUERY does, and return it once it answered.
+func (home *Home) handleAPIQuery(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := StartServerSpan(r, "api.query", "device", id)
+		defer span.Finish()
+		requestId := "api-" + span.TraceIdString()
+		ch := make(chan NotifyState, 1)
+		if !home.waitReady(ctx, readyTimeout) {
+			writeAPIError(w, http.StatusServiceUnavailable, "devices not discovered yet")
+			return
+		}
+
+		home.deviceLock.Lock()
+		d, ok := home.devices[id]
+		if ok {
+			d.OneshotNotify[oneshotKey(requestId, id)] = OneshotRequest{Ch: ch, Id: id, RequestId: requestId}
+			home.sendDeviceQuery(ctx, &d)
+		}
+		home.deviceLock.Unlock()
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "no such device")
+			return
+		}
+
+		updates := home.waitForDevices(ctx, requestId, ch, map[string]bool{id: true})
+		if len(updates) == 0 {
+			writeAPIError(w, http.StatusGatewayTimeout, "the device didn't answer")
+			return
+		}
+		home.deviceLock.Lock()
+		device := home.apiDevice(home.devices[id])
+		home.deviceLock.Unlock()
+		writeJSON(w, http.StatusOK, device)
+	}
+}
+
+// Read or replace the settings of a device. The pin is never shown, and kept if
+// a replacement for a device needing one leaves it out. Google only learns about
+// a changed name or type with the next SYNC.
+func (home *Home) handleAPIConfig(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			config := home.deviceConfig(id)
+			config.Pin = ""
+			writeJSON(w, http.StatusOK, config)
+		case http.MethodPut:
+			var config DeviceConfig
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "cannot decode config: "+err.Error())
+				return
+			}
+			if config.Challenge == "pinNeeded" && config.Pin == "" {
+				config.Pin = home.deviceConfig(id).Pin
+			}
+			saved, err := home.setDeviceConfig(id, config)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			logger.Info("API config", "user", home.User, "device", id, "saved", saved)
+			config.Pin = ""
+			writeJSON(w, http.StatusOK, map[string]interface{}{"config": config, "saved": saved})
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeAPIError(w, http.StatusMethodNotAllowed, "GET or PUT required")
+		}
+	}
+}
+
+func (home *Home) handleAPISync(w http.ResponseWriter, r *http.Request) {
+	ctx, span := StartServerSpan(r, "api.sync")
+	defer span.Finish()
+	if err := home.RequestSync(ctx); err != nil {
+		logger.Warn("Requesting SYNC failed", "user", home.User, "error", err)
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logger.Info("Requested SYNC", "user", home.User)
+	writeJSON(w, http.StatusAccepted, map[string]string{})
+}
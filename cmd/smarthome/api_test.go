@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPICommand(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		body          string
+		wantStatus    int
+		wantPublished string
+	}{
+		{"dimmer", "lamp", `{"command":"Dimmer","payload":"50"}`, http.StatusAccepted, "cmnd/lamp/Dimmer 50"},
+		// the admin may, without the PIN Google would ask for
+		{"lock", "door", `{"command":"Power","payload":"ON"}`, http.StatusAccepted, "cmnd/door/Power ON"},
+		{"backlog", "lamp", `{"command":"Backlog","payload":"Power ON; Dimmer 50"}`, http.StatusBadRequest, ""},
+		{"backlog0", "lamp", `{"command":"BACKLOG0","payload":"Power ON"}`, http.StatusBadRequest, ""},
+		{"rule", "lamp", `{"command":"Rule1","payload":"on Time#Minute do Power ON endon"}`, http.StatusBadRequest, ""},
+		{"script", "lamp", `{"command":"Script","payload":">D"}`, http.StatusBadRequest, ""},
+		{"space", "lamp", `{"command":"Power ON"}`, http.StatusBadRequest, ""},
+		{"topic", "lamp", `{"command":"a/b"}`, http.StatusBadRequest, ""},
+		{"empty", "lamp", `{"payload":"ON"}`, http.StatusBadRequest, ""},
+		{"no device", "tv", `{"command":"Power","payload":"ON"}`, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("lamp", "door")
+			home.Devices = map[string]DeviceConfig{"door": {Type: "lock", Challenge: "pinNeeded", Pin: "1234"}}
+			r := httptest.NewRequest("POST", "/api/homes/test/devices/"+tt.id+"/command", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			home.handleAPICommand(tt.id)(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if published := strings.Join(client.Published(), ","); published != tt.wantPublished {
+				t.Errorf("published %q, want %q", published, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestSetDeviceConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	home := NewHome()
+	home.User = "test"
+	home.devicesFile = filepath.Join(dir, "devices.json")
+	if err := ioutil.WriteFile(home.devicesFile, []byte(`{"lamp":{"name":"Lamp"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := readJSONFile(home.devicesFile, &home.Devices); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := home.setDeviceConfig("door", DeviceConfig{Type: "lock", Challenge: "pinNeeded", Pin: "1234"})
+	if err != nil || !saved {
+		t.Fatalf("setDeviceConfig = %v, %v", saved, err)
+	}
+	// a bad config leaves the file as it was
+	if _, err := home.setDeviceConfig("door", DeviceConfig{Type: "lock"}); err == nil {
+		t.Errorf("lock without a pin accepted")
+	}
+
+	data, err := ioutil.ReadFile(home.devicesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices map[string]DeviceConfig
+	if err := json.Unmarshal(data, &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices["lamp"].Name != "Lamp" || devices["door"].Pin != "1234" {
+		t.Errorf("%s = %v", home.devicesFile, devices)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("files left behind: %d", len(files))
+	}
+	if mode := files[0].Mode().Perm(); mode != 0600 {
+		t.Errorf("mode %v, want 0600", mode)
+	}
+}
+
+// Nothing is published before the devices are discovered, and the client may
+// not even be there yet.
+func TestAPINotReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(home *Home) http.HandlerFunc
+		body    string
+	}{
+		{"command", func(home *Home) http.HandlerFunc { return home.handleAPICommand("lamp") }, `{"command":"Power","payload":"ON"}`},
+		{"query", func(home *Home) http.HandlerFunc { return home.handleAPIQuery("lamp") }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := NewHome()
+			home.User = "test"
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			r := httptest.NewRequest("POST", "/api/homes/test/devices/lamp/"+tt.name, strings.NewReader(tt.body)).WithContext(ctx)
+			w := httptest.NewRecorder()
+			tt.handler(home)(w, r)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body.String())
+			}
+		})
+	}
+}
+
+// The client is replaced under clientLock while commands are published, which
+// the race detector checks.
+func TestMQTTClientSwap(t *testing.T) {
+	home, client := newTestHome("lamp")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			home.clientLock.Lock()
+			home.client = client
+			home.clientLock.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := home.SendCommand(context.Background(), "lamp", "Power", "TOGGLE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if n := len(client.Published()); n != 100 {
+		t.Errorf("%d published, want 100", n)
+	}
+}
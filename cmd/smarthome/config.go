@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// The settings of the bridge. Each is read, in increasing precedence, from its
+// default, the JSON object in the file named by -config or CONFIG_FILE, its
+// environment variable and its command line flag. The keys of the file are the
+// names of the flags, like {"mqtt-addr": "192.168.1.2", "log-level": "DEBUG"}.
+// Run with -help for the list.
+type Config struct {
+	Port     string
+	LogLevel Severity
+
+	// Without UsersFile there is a single home, see LoadHomes.
+	UsersFile    string
+	User         string
+	PasswordHash string
+	MQTTAddr     string
+	MQTTPort     string
+	MQTTUsername string
+	MQTTPassword string
+	DevicesFile  string
+	ScenesFile   string
+
+	OAuthClient     string
+	OAuthSecret     string
+	TokenStore      string
+	RevocationStore string
+	JWTKey          string
+	JWTSigningKey   string
+	JWTVerifyKeys   string
+
+	AdminToken      string
+	AdminAllowedIPs string
+
+	// Off Google Cloud there is no metadata server to ask for the project, the
+	// instance or a token for HomeGraph.
+	Metadata   bool
+	ProjectId  string
+	InstanceId string
+
+	KeepWarmURL      string
+	KeepWarmInterval time.Duration
+
+	OTLPEndpoint       string
+	OTLPTracesEndpoint string
+	OTLPHeaders        string
+	ServiceName        string
+}
+
+var settings *Config
+
+// A setting, with the flag and key in the config file it is known by.
+type configVar struct {
+	name  string
+	env   string
+	usage string
+	set   setter
+}
+
+// Parses a value into a setting.
+type setter interface {
+	Set(s string) error
+}
+
+type setFunc func(string) error
+
+func (f setFunc) Set(s string) error { return f(s) }
+
+// A boolean setting, which like a boolean flag can be given as just -name.
+type boolSetFunc func(string) error
+
+func (f boolSetFunc) Set(s string) error { return f(s) }
+func (f boolSetFunc) IsBoolFlag() bool   { return true }
+
+func setString(p *string) setFunc {
+	return func(s string) error {
+		*p = s
+		return nil
+	}
+}
+
+func setBool(p *bool) boolSetFunc {
+	return func(s string) error {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		*p = b
+		return nil
+	}
+}
+
+func setDuration(p *time.Duration) setFunc {
+	return func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("not a duration like 5m")
+		}
+		*p = d
+		return nil
+	}
+}
+
+func setSeverity(p *Severity) setFunc {
+	return func(s string) error {
+		switch strings.ToUpper(s) {
+		case "DEBUG":
+			*p = SeverityDebug
+		case "INFO":
+			*p = SeverityInfo
+		case "WARNING", "WARN":
+			*p = SeverityWarning
+		case "ERROR":
+			*p = SeverityError
+		default:
+			return fmt.Errorf("not one of DEBUG, INFO, WARNING or ERROR")
+		}
+		return nil
+	}
+}
+
+// The environment variables are those the bridge has always read, and those of
+// the OpenTelemetry SDKs.
+func (c *Config) vars() []configVar {
+	return []configVar{
+		{"port", "PORT", "HTTP port to listen on", setString(&c.Port)},
+		{"log-level", "LOG_LEVEL", "DEBUG, INFO, WARNING or ERROR", setSeverity(&c.LogLevel)},
+
+		{"users-file", "OAUTH_USERS_FILE", "JSON file with the homes, instead of the single home below", setString(&c.UsersFile)},
+		{"user", "OAUTH_USER", "user of the single home", setString(&c.User)},
+		{"password-hash", "OAUTH_PASSWORD_HASH", "bcrypt hash of the password of the user", setString(&c.PasswordHash)},
+		{"mqtt-addr", "MQTT_IP_ADDR", "address of the MQTT broker", setString(&c.MQTTAddr)},
+		{"mqtt-port", "MQTT_PORT", "port of the MQTT broker", setString(&c.MQTTPort)},
+		{"mqtt-username", "MQTT_USERNAME", "username at the MQTT broker", setString(&c.MQTTUsername)},
+		{"mqtt-password", "MQTT_PASSWORD", "password at the MQTT broker", setString(&c.MQTTPassword)},
+		{"devices-file", "DEVICES_FILE", "JSON file with the settings of devices", setString(&c.DevicesFile)},
+		{"scenes-file", "SCENES_FILE", "JSON file with the scenes", setString(&c.ScenesFile)},
+
+		{"oauth-client", "OAUTH_CLIENT", "OAuth client id given to Google", setString(&c.OAuthClient)},
+		{"oauth-secret", "OAUTH_SECRET", "OAuth client secret given to Google", setString(&c.OAuthSecret)},
+		{"token-store", "OAUTH_TOKEN_STORE", "where refresh tokens are kept, see OpenTokenStore", setString(&c.TokenStore)},
+		{"revocation-store", "OAUTH_REVOCATION_STORE", "where revoked tokens are kept, see OpenRevocationList", setString(&c.RevocationStore)},
+		{"jwt-key", "OAUTH_JWT_KEY", "secret for HS512 tokens and other keys derived from it", setString(&c.JWTKey)},
+		{"jwt-signing-key", "OAUTH_JWT_SIGNING_KEY", "PEM or PEM file of the RSA or EC key signing tokens", setString(&c.JWTSigningKey)},
+		{"jwt-verify-keys", "OAUTH_JWT_VERIFY_KEYS", "comma separated PEM files of earlier signing keys", setString(&c.JWTVerifyKeys)},
+
+		{"admin-token", "ADMIN_TOKEN", "bearer token for /api, /metrics and /quitquitquit", setString(&c.AdminToken)},
+		{"admin-allowed-ips", "ADMIN_ALLOWED_IPS", "comma separated addresses and prefixes allowed the same", setString(&c.AdminAllowedIPs)},
+
+		{"metadata", "USE_METADATA", "use the metadata server of Google Cloud, by default on Cloud Run", setBool(&c.Metadata)},
+		{"project-id", "PROJECT_ID", "Google Cloud project, for otherDeviceIds and trace links", setString(&c.ProjectId)},
+		{"instance-id", "INSTANCE_ID", "unique per instance, for the MQTT client ids", setString(&c.InstanceId)},
+
+		{"keep-warm-url", "KEEP_WARM_URL", "public URL of the service to request, see StartKeepWarm", setString(&c.KeepWarmURL)},
+		{"keep-warm-interval", "KEEP_WARM_INTERVAL", "how often to request it", setDuration(&c.KeepWarmInterval)},
+
+		{"otlp-endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTLP/HTTP endpoint, traces go to /v1/traces", setString(&c.OTLPEndpoint)},
+		{"otlp-traces-endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTLP/HTTP endpoint for traces", setString(&c.OTLPTracesEndpoint)},
+		{"otlp-headers", "OTEL_EXPORTER_OTLP_HEADERS", "comma separated key=value headers for the OTLP endpoint", setString(&c.OTLPHeaders)},
+		{"service-name", "OTEL_SERVICE_NAME", "service.name of the traces", setString(&c.ServiceName)},
+	}
+}
+
+// A flag.Value handing the flag to a setting once the file and the environment
+// have been read.
+type flagValue struct {
+	name   string
+	flags  map[string]string
+	isBool bool
+}
+
+func (f flagValue) String() string { return "" }
+
+func (f flagValue) Set(s string) error {
+	f.flags[f.name] = s
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool { return f.isBool }
+
+// Google Cloud Run sets K_SERVICE, and the metadata server is there.
+func onCloudRun() bool {
+	return os.Getenv("K_SERVICE") != ""
+}
+
+// Read the configuration from the command line arguments, without the program
+// name, the config file and the environment.
+func LoadConfig(args []string) (*Config, error) {
+	c := &Config{
+		Port:             "8080",
+		LogLevel:         SeverityInfo,
+		MQTTPort:         "1883",
+		Metadata:         onCloudRun(),
+		KeepWarmInterval: 5 * time.Minute,
+		ServiceName:      "g_assist_mqtt",
+	}
+	vars := c.vars()
+
+	fs := flag.NewFlagSet("smarthome", flag.ContinueOnError)
+	filename := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON file with settings (CONFIG_FILE)")
+	flags := make(map[string]string)
+	for _, v := range vars {
+		_, isBool := v.set.(boolSetFunc)
+		fs.Var(flagValue{name: v.name, flags: flags, isBool: isBool}, v.name, v.usage+" ("+v.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	if *filename != "" {
+		if err := c.readFile(*filename, vars); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range vars {
+		if s := os.Getenv(v.env); s != "" {
+			if err := v.set.Set(s); err != nil {
+				return nil, fmt.Errorf("%s: %v", v.env, err)
+			}
+		}
+	}
+	for _, v := range vars {
+		if s, ok := flags[v.name]; ok {
+			if err := v.set.Set(s); err != nil {
+				return nil, fmt.Errorf("-%s: %v", v.name, err)
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Values in the file may be strings or, like a port, numbers and booleans.
+func (c *Config) readFile(filename string, vars []configVar) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	known := make(map[string]configVar)
+	for _, v := range vars {
+		known[v.name] = v
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := known[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", filename, name)
+		}
+		var s string
+		if err := json.Unmarshal(values[name], &s); err != nil {
+			s = string(values[name])
+		}
+		if err := v.set.Set(s); err != nil {
+			return fmt.Errorf("%s: %s: %v", filename, name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, err := strconv.ParseUint(c.Port, 10, 16); err != nil {
+		return fmt.Errorf("port: %q is not a port", c.Port)
+	}
+	if c.UsersFile == "" {
+		if c.User == "" {
+			return fmt.Errorf("either users-file or user has to be set")
+		}
+		if c.MQTTAddr == "" {
+			return fmt.Errorf("mqtt-addr has to be set")
+		}
+		if _, err := strconv.ParseUint(c.MQTTPort, 10, 16); err != nil {
+			return fmt.Errorf("mqtt-port: %q is not a port", c.MQTTPort)
+		}
+	}
+	if c.OAuthClient == "" {
+		return fmt.Errorf("oauth-client has to be set, no token would be accepted")
+	}
+	if c.JWTKey == "" && c.JWTSigningKey == "" {
+		return fmt.Errorf("either jwt-key or jwt-signing-key has to be set")
+	}
+	for _, s := range strings.Split(c.AdminAllowedIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, err := netaddr.ParseIPPrefix(s); err == nil {
+			continue
+		}
+		if _, err := netaddr.ParseIP(s); err != nil {
+			return fmt.Errorf("admin-allowed-ips: cannot parse %q", s)
+		}
+	}
+	if c.KeepWarmInterval <= 0 {
+		return fmt.Errorf("keep-warm-interval has to be positive")
+	}
+	return nil
+}
+
+// Fill in what the metadata server knows, if the configuration leaves it out.
+// Without it the hostname tells instances apart, which is enough for a bridge
+// running on a machine at home.
+func (c *Config) resolve() {
+	if c.Metadata {
+		if c.ProjectId == "" {
+			c.ProjectId = GetMetadata("v1/project/project-id")
+		}
+		if c.InstanceId == "" {
+			c.InstanceId = GetMetadata("v1/instance/id")
+		}
+	}
+	if c.InstanceId == "" {
+		c.InstanceId, _ = os.Hostname()
+	}
+}
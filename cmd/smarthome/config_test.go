@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set an environment variable, or unset it if value is empty, for the rest of
+// the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	required := []string{"-user", "alice", "-mqtt-addr", "10.0.0.1", "-oauth-client", "google", "-jwt-key", "k"}
+	tests := []struct {
+		name string
+		file string // JSON, none if empty
+		env  map[string]string
+		args []string
+		want func(c *Config) bool
+	}{
+		{"defaults", "", nil, nil, func(c *Config) bool {
+			return c.Port == "8080" && c.LogLevel == SeverityInfo && !c.Metadata && c.KeepWarmInterval == 5*time.Minute
+		}},
+		{"file", `{"port":1000,"log-level":"DEBUG","metadata":true,"keep-warm-interval":"1m"}`, nil, nil, func(c *Config) bool {
+			return c.Port == "1000" && c.LogLevel == SeverityDebug && c.Metadata && c.KeepWarmInterval == time.Minute
+		}},
+		{"env over file", `{"port":"1000","metadata":false}`, map[string]string{"PORT": "2000", "USE_METADATA": "true"}, nil,
+			func(c *Config) bool { return c.Port == "2000" && c.Metadata }},
+		{"flag over env and file", `{"port":"1000"}`, map[string]string{"PORT": "2000", "USE_METADATA": "true"},
+			[]string{"-port", "3000", "-metadata=false"}, func(c *Config) bool { return c.Port == "3000" && !c.Metadata }},
+		{"bare bool flag", "", nil, []string{"-metadata"}, func(c *Config) bool { return c.Metadata }},
+		{"single home from the environment", "", map[string]string{"OAUTH_USER": "bob", "MQTT_IP_ADDR": "10.0.0.2"}, nil,
+			// the flags in required still win
+			func(c *Config) bool { return c.User == "alice" && c.MQTTAddr == "10.0.0.1" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "K_SERVICE", "")
+			for _, v := range (&Config{}).vars() {
+				setenv(t, v.env, tt.env[v.env])
+			}
+			setenv(t, "CONFIG_FILE", "")
+			args := append([]string(nil), required...)
+			if tt.file != "" {
+				filename := filepath.Join(t.TempDir(), "config.json")
+				if err := ioutil.WriteFile(filename, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", filename)
+			}
+			c, err := LoadConfig(append(args, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(c) {
+				t.Errorf("config %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown in file", `{"colour":"blue"}`, nil, nil, `unknown setting "colour"`},
+		{"bad bool in env", "", map[string]string{"USE_METADATA": "maybe"}, nil, "USE_METADATA: not a boolean"},
+		{"bad duration flag", "", nil, []string{"-keep-warm-interval", "5"}, "-keep-warm-interval: not a duration"},
+		{"bad level in file", `{"log-level":"LOUD"}`, nil, nil, "log-level: not one of"},
+		{"argument", "", nil, []string{"extra"}, "unexpected arguments"},
+		{"invalid", "", map[string]string{"PORT": "http"}, nil, `port: "http" is not a port`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range (&Config{}).vars() {
+				setenv(t, v.env, tt.env[v.env])
+			}
+			setenv(t, "CONFIG_FILE", "")
+			args := []string{"-user", "alice", "-mqtt-addr", "10.0.0.1", "-oauth-client", "google", "-jwt-key", "k"}
+			if tt.file != "" {
+				filename := filepath.Join(t.TempDir(), "config.json")
+				if err := ioutil.WriteFile(filename, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", filename)
+			}
+			_, err := LoadConfig(append(args, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() Config {
+		return Config{Port: "8080", User: "alice", MQTTAddr: "10.0.0.1", MQTTPort: "1883",
+			OAuthClient: "google", JWTKey: "k", KeepWarmInterval: time.Minute}
+	}
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"users file instead", func(c *Config) { c.User, c.MQTTAddr, c.UsersFile = "", "", "users.json" }, ""},
+		{"signing key instead", func(c *Config) { c.JWTKey, c.JWTSigningKey = "", "key.pem" }, ""},
+		{"allowed ips", func(c *Config) { c.AdminAllowedIPs = "100.64.0.0/10, 192.168.1.5," }, ""},
+		{"bad port", func(c *Config) { c.Port = "70000" }, "port"},
+		{"no user", func(c *Config) { c.User = "" }, "either users-file or user"},
+		{"no broker", func(c *Config) { c.MQTTAddr = "" }, "mqtt-addr"},
+		{"bad broker port", func(c *Config) { c.MQTTPort = "mqtt" }, "mqtt-port"},
+		{"no client", func(c *Config) { c.OAuthClient = "" }, "oauth-client"},
+		{"no key", func(c *Config) { c.JWTKey = "" }, "either jwt-key or jwt-signing-key"},
+		{"bad allowed ip", func(c *Config) { c.AdminAllowedIPs = "10.0.0.300" }, "admin-allowed-ips"},
+		{"zero interval", func(c *Config) { c.KeepWarmInterval = 0 }, "keep-warm-interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A dashboard for the user of a home at /dashboard, signed in with the same
+// password as for account linking. It lists the devices discovered, lets them
+// be switched on and off, and follows changes with server-sent events.
+const (
+	sessionCookieName = "smarthome_session"
+	sessionExp        = 12 * time.Hour
+
+	// Streams of events end before the WriteTimeout of the server cuts them
+	// off, and the browser reconnects.
+	eventStreamDuration = 8 * time.Second
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<html>
+<head><title>Smart Home</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.offline { color: #999; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+{{if .User}}<form method="POST" action="/dashboard/logout" style="float: right">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{.User}} <button type="submit">Sign out</button>
+</form>
+<h1>Devices</h1>
+<table>
+<tr><th>Name</th><th>Topic</th><th>IP</th><th>Firmware</th><th>Online</th><th>Power</th><th>Last seen</th><th>Signal</th><th></th></tr>
+{{range .Devices}}<tr id="{{.Id}}"{{if not .Online}} class="offline"{{end}}>
+<td>{{.Name}}</td><td>{{.Topic}}</td><td>{{.IP}}</td><td>{{.Firmware}}</td>
+<td data-field="online">{{if .Online}}yes{{else}}no{{end}}</td>
+<td data-field="power">{{.PowerState}}</td>
+<td data-field="lastSeen">{{.LastSeen}}</td>
+<td data-field="signal">{{if .Signal}}{{.RSSI}}% ({{.Signal}} dBm){{end}}</td>
+<td>{{if .HasOnOff}}<form method="POST" action="/dashboard/power">
+<input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.Id}}">
+<button type="submit" name="power" value="ON">On</button>
+<button type="submit" name="power" value="OFF">Off</button>
+</form>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="9">No devices discovered yet.</td></tr>
+{{end}}</table>
+<script>
+new EventSource("/dashboard/events").addEventListener("devices", function(e) {
+  JSON.parse(e.data).forEach(function(d) {
+    var row = document.getElementById(d.id);
+    if (!row) return;
+    row.className = d.online ? "" : "offline";
+    row.querySelector('[data-field="online"]').textContent = d.online ? "yes" : "no";
+    row.querySelector('[data-field="power"]').textContent = d.powerState;
+    row.querySelector('[data-field="lastSeen"]').textContent = d.lastSeen;
+    row.querySelector('[data-field="signal"]').textContent =
+      d.signal ? d.rssi + "% (" + d.signal + " dBm)" : "";
+  });
+});
+</script>
+{{else}}<h1>Smart Home</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="POST" action="/dashboard/login">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><label>Username <input type="text" name="username" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<button type="submit">Sign in</button>
+</form>
+{{end}}</body>
+</html>`))
+
+type dashboardPage struct {
+	User    string
+	CSRF    string
+	Error   string
+	Devices []dashboardDevice
+}
+
+// A row of the dashboard, also sent as JSON in events.
+type dashboardDevice struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Topic      string `json:"topic"`
+	IP         string `json:"ip"`
+	Firmware   string `json:"firmware"`
+	Online     bool   `json:"online"`
+	HasOnOff   bool   `json:"hasOnOff"`
+	PowerState string `json:"powerState"`
+	LastSeen   string `json:"lastSeen"`
+	RSSI       int    `json:"rssi"`   // percent
+	Signal     int    `json:"signal"` // dBm, 0 if unknown
+}
+
+func (home *Home) dashboardDevices() []dashboardDevice {
+	home.deviceLock.Lock()
+	devices := make([]dashboardDevice, 0, len(home.devices))
+	for address, d := range home.devices {
+		row := dashboardDevice{
+			Id:         address,
+			Name:       d.Name(),
+			Topic:      d.TopicName,
+			IP:         d.IP,
+			Firmware:   d.Software,
+			Online:     d.Online,
+			HasOnOff:   d.HasOnOff,
+			PowerState: d.PowerState,
+			RSSI:       d.RSSI,
+			Signal:     d.Signal,
+		}
+		if !d.LastSeen.IsZero() {
+			row.LastSeen = d.LastSeen.Format("2006-01-02 15:04:05")
+		}
+		devices = append(devices, row)
+	}
+	home.deviceLock.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+// Wake up the dashboards following the devices of the home, with the device
+// lock held. A dashboard which hasn't caught up with the last change yet will
+// see this one too, so nothing waits.
+func (home *Home) notifyWatchers() {
+	for ch := range home.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// The session cookie holds the user and when it expires, signed like a login
+// ticket but with a key of its own. That key is derived from the key signing
+// access tokens, so rotating it signs everyone out of the dashboard.
+func signSession(user string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." +
+		strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sessionMAC(payload)
+}
+
+func sessionMAC(payload string) string {
+	mac := hmac.New(sha256.New, jwtKeys.SecretKey("dashboard session"))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The home of the user signed in to the dashboard, if any.
+func sessionHome(r *http.Request) (*Home, bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sessionMAC(payload))) {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	home, ok := homes[string(user)]
+	return home, ok
+}
+
+func setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/dashboard",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func renderDashboard(w http.ResponseWriter, r *http.Request, page dashboardPage) {
+	page.CSRF = csrfToken(w, r, "/dashboard")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		logger.Error("Dashboard template failed", "error", err)
+	}
+}
+
+func HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	home, ok := sessionHome(r)
+	if !ok {
+		renderDashboard(w, r, dashboardPage{})
+		return
+	}
+	renderDashboard(w, r, dashboardPage{User: home.User, Devices: home.dashboardDevices()})
+}
+
+func HandleDashboardLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	user := r.PostFormValue("username")
+	if loginLockedOut(user, clientIP(r)) {
+		logger.Warn("Dashboard login locked out", "user", user, "remoteAddr", r.RemoteAddr)
+		renderDashboard(w, r, dashboardPage{Error: "Too many failed attempts, please try again later"})
+		return
+	}
+	if !checkPassword(user, clientIP(r), r.PostFormValue("password")) {
+		logger.Warn("Dashboard login failed", "user", user, "remoteAddr", r.RemoteAddr)
+		renderDashboard(w, r, dashboardPage{Error: "Incorrect username or password"})
+		return
+	}
+	setSessionCookie(w, signSession(user, time.Now().Add(sessionExp)), int(sessionExp/time.Second))
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+func HandleDashboardLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	setSessionCookie(w, "", -1)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// Switch a device on or off from the dashboard. Like the Assistant, the
+// dashboard may not switch devices needing a challenge.
+func HandleDashboardPower(w http.ResponseWriter, r *http.Request) {
+	home, ok := sessionHome(r)
+	if !ok || r.Method != http.MethodPost || !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !home.waitReady(r.Context(), readyTimeout) {
+		http.Error(w, "Devices not discovered yet, try again", http.StatusServiceUnavailable)
+		return
+	}
+	id := r.PostFormValue("id")
+	if home.deviceConfig(id).Challenge != "" {
+		http.Error(w, "This device can only be switched with the Assistant", http.StatusForbidden)
+		return
+	}
+
+	home.deviceLock.Lock()
+	d, ok := home.devices[id]
+	if ok && d.HasOnOff {
+		d.SendPowerOnOff(r.Context(), r.PostFormValue("power") == "ON")
+	}
+	home.deviceLock.Unlock()
+	if !ok {
+		http.Error(w, "No such device", http.StatusNotFound)
+		return
+	}
+	log.Printf("Dashboard: %s switched %s %s\n", home.User, id, r.PostFormValue("power"))
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// Server-sent events with the rows of the dashboard, whenever a device changed.
+func HandleDashboardEvents(w http.ResponseWriter, r *http.Request) {
+	home, ok := sessionHome(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{} // the current rows first, changes may have been missed while reconnecting
+	home.deviceLock.Lock()
+	home.watchers[ch] = true
+	home.deviceLock.Unlock()
+	defer func() {
+		home.deviceLock.Lock()
+		delete(home.watchers, ch)
+		home.deviceLock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	end := time.After(eventStreamDuration)
+	for {
+		select {
+		case <-ch:
+			data, err := json.Marshal(home.dashboardDevices())
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: devices\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-end:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
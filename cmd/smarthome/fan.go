@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Sonoff iFan02/03 modules have a light on relay 1 and a fan with speeds 0-3 on
+// the others. The fan is the device with the MAC address as its id, and the
+// light a second device with lightIdSuffix appended.
+const lightIdSuffix = "-light"
+
+// The speed_name of each of Tasmota's FanSpeed values.
+var fanSpeedNames = []string{"off", "low", "medium", "high"}
+
+var fanSpeedSynonyms = map[string][]string{
+	"off":    {"off", "stopped"},
+	"low":    {"low", "slow", "speed 1"},
+	"medium": {"medium", "speed 2"},
+	"high":   {"high", "fast", "speed 3"},
+}
+
+// https://developers.google.com/assistant/smarthome/traits/fanspeed
+type IntentSyncResponseFanSpeeds struct {
+	Speeds  []IntentSyncResponseFanSpeed `json:"speeds"`
+	Ordered bool                         `json:"ordered"`
+}
+
+type IntentSyncResponseFanSpeed struct {
+	SpeedName   string `json:"speed_name"`
+	SpeedValues []struct {
+		SpeedSynonym []string `json:"speed_synonym"`
+		Lang         string   `json:"lang"`
+	} `json:"speed_values"`
+}
+
+func isIFan(model string) bool {
+	return strings.Contains(strings.ToLower(model), "ifan")
+}
+
+// The MAC address of the Tasmota device behind a Google device id, and whether
+// the id is that of the light of an iFan.
+func splitDeviceId(id string) (string, bool) {
+	if strings.HasSuffix(id, lightIdSuffix) {
+		return strings.TrimSuffix(id, lightIdSuffix), true
+	}
+	return id, false
+}
+
+func fanSpeedName(speed int) string {
+	if speed < 0 || speed >= len(fanSpeedNames) {
+		return ""
+	}
+	return fanSpeedNames[speed]
+}
+
+func fanSpeedValue(name string) (int, bool) {
+	for speed, n := range fanSpeedNames {
+		if n == name {
+			return speed, true
+		}
+	}
+	return 0, false
+}
+
+func fanSpeedAttributes() *IntentSyncResponseFanSpeeds {
+	speeds := &IntentSyncResponseFanSpeeds{Ordered: true}
+	for _, name := range fanSpeedNames {
+		speed := IntentSyncResponseFanSpeed{SpeedName: name}
+		speed.SpeedValues = make([]struct {
+			SpeedSynonym []string `json:"speed_synonym"`
+			Lang         string   `json:"lang"`
+		}, 1)
+		speed.SpeedValues[0].SpeedSynonym = fanSpeedSynonyms[name]
+		speed.SpeedValues[0].Lang = "en"
+		speeds.Speeds = append(speeds.Speeds, speed)
+	}
+	return speeds
+}
+
+// Produce the Device portion of a SYNC response for the light of an iFan.
+func (device *TasmotaDevice) ToIntentSyncResponseLight() IntentSyncResponseDevice {
+	sync := device.ToIntentSyncResponseDevice()
+	sync.Id = device.MacAddress + lightIdSuffix
+	sync.Type = "action.devices.types.LIGHT"
+	sync.Traits = []string{"action.devices.traits.OnOff"}
+	sync.Attributes = nil
+	sync.Name.Name = device.Name() + " Light"
+	sync.OtherDeviceIds.DeviceId = device.Hostname + lightIdSuffix
+	return sync
+}
+
+// to be called from fulfillment goroutines to set the speed of an iFan, 0 is off.
+func (device *TasmotaDevice) SendFanSpeed(ctx context.Context, speed int) {
+	device.sendCommand(ctx, "FanSpeed", strconv.Itoa(speed))
+}
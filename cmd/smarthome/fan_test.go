@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFanSpeeds(t *testing.T) {
+	tests := []struct {
+		speed int
+		name  string
+	}{
+		{0, "off"},
+		{1, "low"},
+		{2, "medium"},
+		{3, "high"},
+	}
+	for _, tt := range tests {
+		if got := fanSpeedName(tt.speed); got != tt.name {
+			t.Errorf("fanSpeedName(%d) = %q, want %q", tt.speed, got, tt.name)
+		}
+		if got, ok := fanSpeedValue(tt.name); !ok || got != tt.speed {
+			t.Errorf("fanSpeedValue(%q) = %d %v, want %d", tt.name, got, ok, tt.speed)
+		}
+	}
+	if name := fanSpeedName(4); name != "" {
+		t.Errorf("fanSpeedName(4) = %q", name)
+	}
+	if _, ok := fanSpeedValue("turbo"); ok {
+		t.Errorf("fanSpeedValue(turbo) ok")
+	}
+}
+
+func TestSplitDeviceId(t *testing.T) {
+	tests := []struct {
+		id      string
+		address string
+		isLight bool
+	}{
+		{"BCDDC2000000", "BCDDC2000000", false},
+		{"BCDDC2000000-light", "BCDDC2000000", true},
+	}
+	for _, tt := range tests {
+		address, isLight := splitDeviceId(tt.id)
+		if address != tt.address || isLight != tt.isLight {
+			t.Errorf("splitDeviceId(%q) = %q %v", tt.id, address, isLight)
+		}
+	}
+}
+
+// A home with an iFan at speed on topic "fan", whose light is off.
+func newTestFanHome(speed, lastSpeed int) (*Home, *fakeClient) {
+	home, client := newTestHome("fan")
+	fan := home.devices["fan"]
+	fan.IsFan = true
+	fan.Hardware = "Sonoff iFan03"
+	fan.FanSpeed = speed
+	fan.LastFanSpeed = lastSpeed
+	home.devices["fan"] = fan
+	simulateTasmota(home, client)
+	return home, client
+}
+
+func TestFanSync(t *testing.T) {
+	settings = &Config{}
+	home, _ := newTestFanHome(0, 0)
+	data, err := home.GenerateSyncResponse(context.Background(), IntentSyncRequest{RequestId: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentSyncResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range resp.Payload.Devices {
+		got = append(got, d.Id+" "+d.Type+" "+strings.Join(d.Traits, ","))
+	}
+	sort.Strings(got)
+	want := []string{
+		"fan action.devices.types.FAN action.devices.traits.OnOff,action.devices.traits.FanSpeed",
+		"fan-light action.devices.types.LIGHT action.devices.traits.OnOff",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("SYNC:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFanExecute(t *testing.T) {
+	tests := []struct {
+		name          string
+		speed, last   int
+		id            string
+		execution     string
+		wantResponse  string
+		wantPublished string
+	}{
+		{"on at the last speed", 0, 2, "fan", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			"fan SUCCESS on=true speed=medium", "cmnd/fan/FanSpeed 2"},
+		{"on without a last speed", 0, 0, "fan", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			"fan SUCCESS on=true speed=low", "cmnd/fan/FanSpeed 1"},
+		{"off", 3, 3, "fan", `{"command":"action.devices.commands.OnOff","params":{"on":false}}`,
+			"fan SUCCESS on=false speed=off", "cmnd/fan/FanSpeed 0"},
+		{"set speed", 1, 1, "fan", `{"command":"action.devices.commands.SetFanSpeed","params":{"fanSpeed":"high"}}`,
+			"fan SUCCESS on=true speed=high", "cmnd/fan/FanSpeed 3"},
+		{"unknown speed", 1, 1, "fan", `{"command":"action.devices.commands.SetFanSpeed","params":{"fanSpeed":"turbo"}}`,
+			"fan ERROR valueOutOfRange", ""},
+		{"light on", 1, 1, "fan-light", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			"fan-light SUCCESS on=true", "cmnd/fan/power ON"},
+		{"no speed for the light", 1, 1, "fan-light",
+			`{"command":"action.devices.commands.SetFanSpeed","params":{"fanSpeed":"low"}}`,
+			"fan-light ERROR functionNotSupported", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestFanHome(tt.speed, tt.last)
+			data, err := home.GenerateExecuteResponse(context.Background(), executeRequest(tt.id, tt.execution))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := summarizeExecute(decodeExecuteResponse(t, data))
+			if len(got) != 1 || got[0] != tt.wantResponse {
+				t.Errorf("response %v, want %q", got, tt.wantResponse)
+			}
+			if published := strings.Join(client.Published(), ","); published != tt.wantPublished {
+				t.Errorf("published %q, want %q", published, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestFanQuery(t *testing.T) {
+	home, _ := newTestFanHome(2, 2)
+	var query IntentQueryRequest
+	if err := json.Unmarshal([]byte(`{"requestId":"r1","inputs":[{"intent":"action.devices.QUERY",
+		"payload":{"devices":[{"id":"fan"},{"id":"fan-light"}]}}]}`), &query); err != nil {
+		t.Fatal(err)
+	}
+	data, err := home.GenerateQueryResponse(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	devices := make(map[string]IntentQueryResponseDevice)
+	for _, d := range resp.Payload.Devices {
+		devices[d.Id] = d
+	}
+	if d := devices["fan"]; !d.On || d.CurrentFanSpeedSetting != "medium" || d.Status != StatusSuccess {
+		t.Errorf("fan = %+v", d)
+	}
+	if d := devices["fan-light"]; d.On || d.CurrentFanSpeedSetting != "" || d.Status != StatusSuccess {
+		t.Errorf("light = %+v", d)
+	}
+}
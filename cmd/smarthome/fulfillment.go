@@ -2,12 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// How long a QUERY or EXECUTE waits for its devices to answer, in total, before
+// reporting those still silent offline. Google gives up on the whole request
+// after about 10 seconds.
+const deviceResponseTimeout = 5 * time.Second
+
+// How long a request waits for the devices of its home to be discovered after a
+// cold start. With deviceResponseTimeout it has to fit in the WriteTimeout.
+const readyTimeout = 4 * time.Second
+
 // -----------------------------------------------------------------------------
 
 // https://developers.google.com/assistant/smarthome/reference/intent/sync
@@ -35,7 +51,8 @@ type IntentSyncResponseDevice struct {
 		DefaultNames []string `json:"defaultNames"`
 		Name         string   `json:"name"`
 	} `json:"name"`
-	WillReportState bool `json:"willReportState"`
+	WillReportState bool                          `json:"willReportState"`
+	Attributes      *IntentSyncResponseAttributes `json:"attributes,omitempty"`
 	DeviceInfo      struct {
 		Manufacturer string `json:"manufacturer,omitempty"`
 		Model        string `json:"model,omitempty"`
@@ -47,15 +64,32 @@ type IntentSyncResponseDevice struct {
 	} `json:"otherDeviceIds,omitempty"`
 }
 
-func GenerateSyncResponse(req IntentSyncRequest) ([]byte, error) {
+// The attributes of the traits we implement.
+type IntentSyncResponseAttributes struct {
+	SceneReversible    bool                         `json:"sceneReversible,omitempty"`
+	MaxTimerLimitSec   int                          `json:"maxTimerLimitSec,omitempty"`
+	AvailableFanSpeeds *IntentSyncResponseFanSpeeds `json:"availableFanSpeeds,omitempty"`
+
+	AvailableThermostatModes   []string                            `json:"availableThermostatModes,omitempty"`
+	ThermostatTemperatureUnit  string                              `json:"thermostatTemperatureUnit,omitempty"`
+	ThermostatTemperatureRange *IntentSyncResponseTemperatureRange `json:"thermostatTemperatureRange,omitempty"`
+}
+
+func (home *Home) GenerateSyncResponse(ctx context.Context, req IntentSyncRequest) ([]byte, error) {
 	var resp IntentSyncResponse
 	resp.RequestId = req.RequestId
-	resp.Payload.AgentUserId = AgentUserId
+	resp.Payload.AgentUserId = home.AgentUserId
 
-	deviceLock.Lock()
-	defer deviceLock.Unlock()
-	for _, d := range devices {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	for _, d := range home.devices {
 		resp.Payload.Devices = append(resp.Payload.Devices, d.ToIntentSyncResponseDevice())
+		if d.IsFan {
+			resp.Payload.Devices = append(resp.Payload.Devices, d.ToIntentSyncResponseLight())
+		}
+	}
+	for id, scene := range home.Scenes {
+		resp.Payload.Devices = append(resp.Payload.Devices, scene.ToIntentSyncResponseDevice(id))
 	}
 
 	return json.Marshal(resp)
@@ -80,53 +114,160 @@ type IntentQueryRequest struct {
 type IntentQueryResponse struct {
 	RequestId string `json:"requestId"`
 	Payload   struct {
-		ErrorCode   string                      `json:"errorCode,omitempty"`
+		ErrorCode   IntentErrorCode             `json:"errorCode,omitempty"`
 		DebugString string                      `json:"debugString,omitempty"`
 		Devices     []IntentQueryResponseDevice `json:"devices"`
 	} `json:"payload"`
 }
 
 type IntentQueryResponseDevice struct {
-	Id     string `json:"id"`
-	Online bool   `json:"online"`
-	Status string `json:"status"`
-	On     bool   `json:"on,omitempty"`
+	Id                            string          `json:"id"`
+	Online                        bool            `json:"online"`
+	Status                        IntentStatus    `json:"status"`
+	On                            bool            `json:"on,omitempty"`
+	TimerRemainingSec             int             `json:"timerRemainingSec,omitempty"`
+	TimerPaused                   bool            `json:"timerPaused,omitempty"`
+	CurrentFanSpeedSetting        string          `json:"currentFanSpeedSetting,omitempty"` // one of fanSpeedNames
+	ThermostatMode                string          `json:"thermostatMode,omitempty"`
+	ThermostatTemperatureSetpoint float64         `json:"thermostatTemperatureSetpoint,omitempty"`
+	ThermostatTemperatureAmbient  float64         `json:"thermostatTemperatureAmbient,omitempty"`
+	IsLocked                      *bool           `json:"isLocked,omitempty"` // see isLockedState
+	ErrorCode                     IntentErrorCode `json:"errorCode,omitempty"`
+}
+
+// Wait for the devices in pending, keyed by id, to answer requestId on ch. Once
+// the deadline of ctx, at most deviceResponseTimeout away, has passed the devices
+// still pending stop listening, and are left in pending for the caller to report
+// as offline.
+func (home *Home) waitForDevices(ctx context.Context, requestId string, ch chan NotifyState, pending map[string]bool) []NotifyState {
+	ctx, cancel := context.WithTimeout(ctx, deviceResponseTimeout)
+	defer cancel()
+	var updates []NotifyState
+	spans := make(map[string]*Span)
+	for id := range pending {
+		_, spans[id] = StartSpan(ctx, "device.wait", SpanKindInternal, "requestId", requestId, "device", id)
+	}
+	received := func(update NotifyState) {
+		updates = append(updates, update)
+		delete(pending, update.Id)
+		if span, ok := spans[update.Id]; ok {
+			span.Finish()
+		}
+	}
+	defer func() {
+		for id := range pending {
+			spans[id].SetAttributes("timedOut", true)
+			spans[id].SetError("no reply from the device")
+			spans[id].Finish()
+		}
+	}()
+	for len(pending) > 0 {
+		select {
+		case update := <-ch:
+			received(update)
+		case <-ctx.Done():
+			home.deviceLock.Lock()
+			for id := range pending {
+				address, _ := splitDeviceId(id)
+				if d, ok := home.devices[address]; ok {
+					delete(d.OneshotNotify, oneshotKey(requestId, id))
+				}
+			}
+			home.deviceLock.Unlock()
+
+			// an update may have been sent before we took the lock
+			for {
+				select {
+				case update := <-ch:
+					received(update)
+				default:
+					return updates
+				}
+			}
+		}
+	}
+	return updates
 }
 
-func GenerateQueryResponse(req IntentQueryRequest) ([]byte, error) {
+// Ask a device for its state, with the device lock held. The listeners in its
+// OneshotNotify get the reply.
+func (home *Home) sendDeviceQuery(ctx context.Context, d *TasmotaDevice) {
+	if d.IsThermostat() || (d.IsLock() && d.Config().LockSensor != "") {
+		// only sensor status has the thermostat and switch inputs
+		err := home.SendCommand(ctx, d.TopicName, "Status", "10")
+		if err != nil {
+			log.Printf("DeviceQuery: %v\n", err)
+		}
+	} else {
+		topic := "/cmnd/" + d.TopicName + "/STATE"
+		home.SendQuery(ctx, topic)
+	}
+}
+
+func (home *Home) GenerateQueryResponse(ctx context.Context, req IntentQueryRequest) ([]byte, error) {
 	var resp IntentQueryResponse
 	resp.RequestId = req.RequestId
+	start := time.Now()
 	responseCh := make(chan NotifyState, len(req.Inputs[0].Payload.Devices))
 
-	n := 0
-	deviceLock.Lock()
+	pending := make(map[string]bool)
+	home.deviceLock.Lock()
 	for _, q := range req.Inputs[0].Payload.Devices {
-		d, ok := devices[q.Id]
-		if !ok {
-			var offline IntentQueryResponseDevice
-			offline.Id = q.Id
-			offline.Online = false
-			offline.Status = "OFFLINE"
-			resp.Payload.Devices = append(resp.Payload.Devices, offline)
+		d, ok := home.lookupDevice(q.Id)
+		if _, isScene := home.Scenes[q.Id]; isScene {
+			// scenes have no state, they are always there
+			scene := IntentQueryResponseDevice{Id: q.Id, Online: true, Status: StatusSuccess}
+			resp.Payload.Devices = append(resp.Payload.Devices, scene)
+		} else if !ok {
+			var unknown IntentQueryResponseDevice
+			unknown.Id = q.Id
+			unknown.Online = false
+			unknown.Status = StatusError
+			unknown.ErrorCode = ErrorDeviceNotFound
+			resp.Payload.Devices = append(resp.Payload.Devices, unknown)
 		} else {
-			d.OneshotNotify[req.RequestId] = responseCh
-			topic := "/cmnd/" + d.TopicName + "/STATE"
-			SendQuery(topic)
-			n = n + 1
+			d.OneshotNotify[oneshotKey(req.RequestId, q.Id)] = OneshotRequest{Ch: responseCh, Id: q.Id,
+				RequestId: req.RequestId}
+			logger.Debug("MQTT query", "requestId", req.RequestId, "device", q.Id, "topic", d.TopicName)
+			home.sendDeviceQuery(ctx, &d)
+			pending[q.Id] = true
 		}
 	}
-	deviceLock.Unlock()
+	home.deviceLock.Unlock()
 
-	for ; n > 0; n-- {
-		update := <-responseCh
-		query := IntentQueryResponseDevice{Id: update.Id, Online: true, Status: "SUCCESS"}
+	for _, update := range home.waitForDevices(ctx, req.RequestId, responseCh, pending) {
+		metricDeviceRoundTrip.ObserveSince(start, "QUERY", update.Id)
+		query := IntentQueryResponseDevice{Id: update.Id, Online: true, Status: StatusSuccess}
 		if update.PowerState == "ON" {
 			query.On = true
 		} else {
 			query.On = false
 		}
+		address, isLight := splitDeviceId(update.Id)
+		home.deviceLock.Lock()
+		if d, ok := home.devices[address]; ok && d.IsFan && !isLight {
+			query.On = update.FanSpeed > 0
+			query.CurrentFanSpeedSetting = fanSpeedName(update.FanSpeed)
+		} else if ok && d.IsLock() {
+			query.On = false
+			query.IsLocked = isLockedState(update.IsLocked)
+		} else if ok && d.IsThermostat() {
+			query.On = false
+			query.ThermostatMode = thermostatModeName(update.ThermostatMode)
+			query.ThermostatTemperatureSetpoint = update.TempTarget
+			query.ThermostatTemperatureAmbient = update.TempAmbient
+		} else if ok && d.HasTimer() {
+			query.TimerRemainingSec, query.TimerPaused = home.timerState(update.Id)
+		}
+		home.deviceLock.Unlock()
 		resp.Payload.Devices = append(resp.Payload.Devices, query)
 	}
+	for id := range pending {
+		metricDeviceTimeouts.Inc("QUERY", id)
+		offline := IntentQueryResponseDevice{Id: id, Online: false, Status: StatusOffline,
+			ErrorCode: ErrorDeviceOffline}
+		resp.Payload.Devices = append(resp.Payload.Devices, offline)
+	}
 
 	return json.Marshal(resp)
 }
@@ -159,97 +300,372 @@ type IntentExecuteRequest struct {
 				Devices []struct {
 					Id string `json:"id"`
 				} `json:"devices"`
-				Execution []struct {
-					Command string `json:"command"`
-					Params  struct {
-						On bool `json:"on,omitempty"`
-					} `json:"params"`
-				} `json:"execution"`
+				Execution []IntentExecuteRequestExecution `json:"execution"`
 			} `json:"commands"`
 		} `json:"payload"`
 	} `json:"inputs"`
 }
 
+type IntentExecuteRequestExecution struct {
+	Command string `json:"command"`
+	Params  struct {
+		On           bool   `json:"on,omitempty"`
+		Deactivate   bool   `json:"deactivate,omitempty"`
+		TimerTimeSec int    `json:"timerTimeSec,omitempty"`
+		FanSpeed     string `json:"fanSpeed,omitempty"`
+
+		ThermostatMode                string  `json:"thermostatMode,omitempty"`
+		ThermostatTemperatureSetpoint float64 `json:"thermostatTemperatureSetpoint,omitempty"`
+
+		Lock bool `json:"lock,omitempty"`
+	} `json:"params"`
+	// The user's answer to a challenge we returned for a previous request.
+	Challenge struct {
+		Ack bool   `json:"ack,omitempty"`
+		Pin string `json:"pin,omitempty"`
+	} `json:"challenge"`
+}
+
 // https://developers.google.com/assistant/smarthome/reference/intent/execute
 // but supplemented with undocumented fields that Google sends like Context.
 type IntentExecuteResponse struct {
 	RequestId string `json:"requestId"`
 	Payload   struct {
-		ErrorCode   string                         `json:"errorCode,omitempty"`
+		ErrorCode   IntentErrorCode                `json:"errorCode,omitempty"`
 		DebugString string                         `json:"debugString,omitempty"`
 		Commands    []IntentExecuteResponseCommand `json:"commands"`
 	} `json:"payload"`
 }
 
 type IntentExecuteResponseCommand struct {
-	Ids    []string `json:"ids"`
-	Status string   `json:"status"`
-	States struct {
-		On     bool `json:"on,omitempty"`
-		Online bool `json:"online,omitempty"`
-	} `json:"states,omitempty"`
-	ErrorCode string `json:"errorCode,omitempty"`
+	Ids             []string                     `json:"ids"`
+	Status          IntentStatus                 `json:"status"`
+	States          *IntentExecuteResponseStates `json:"states,omitempty"`
+	ErrorCode       IntentErrorCode              `json:"errorCode,omitempty"`
+	ChallengeNeeded *struct {
+		Type IntentChallengeType `json:"type"`
+	} `json:"challengeNeeded,omitempty"`
+}
+
+type IntentExecuteResponseStates struct {
+	On                            bool    `json:"on,omitempty"`
+	Online                        bool    `json:"online,omitempty"`
+	TimerRemainingSec             int     `json:"timerRemainingSec,omitempty"`
+	TimerPaused                   bool    `json:"timerPaused,omitempty"`
+	CurrentFanSpeedSetting        string  `json:"currentFanSpeedSetting,omitempty"` // one of fanSpeedNames
+	ThermostatMode                string  `json:"thermostatMode,omitempty"`
+	ThermostatTemperatureSetpoint float64 `json:"thermostatTemperatureSetpoint,omitempty"`
+	ThermostatTemperatureAmbient  float64 `json:"thermostatTemperatureAmbient,omitempty"`
+	IsLocked                      *bool   `json:"isLocked,omitempty"` // see isLockedState
+}
+
+// The outcome of executing commands on one device. Devices with the same
+// outcome share one IntentExecuteResponseCommand.
+type ExecutionResult struct {
+	Status    IntentStatus
+	ErrorCode IntentErrorCode
+	States    IntentExecuteResponseStates
+	Challenge IntentChallengeType
+}
+
+// After maxPinFailures wrong PINs in a row for a device no PIN is accepted for
+// it until pinLockout has passed, so that a short PIN can't be found by trying
+// them all. The count is kept in memory by each instance: with N instances
+// serving /fulfillment up to N*maxPinFailures PINs can be tried per pinLockout,
+// and a restarted instance starts counting again. Run a single instance (Cloud
+// Run --max-instances=1) where that matters, or choose a longer PIN.
+const (
+	maxPinFailures = 5
+	pinLockout     = 15 * time.Minute
+)
+
+type pinFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// Check the execution answers the challenge configured for the device, if any.
+// Returns the result to send back to Google if it doesn't.
+func (home *Home) checkChallenge(id string, execution IntentExecuteRequestExecution) (ExecutionResult, bool) {
+	config := home.deviceConfig(id)
+	switch config.Challenge {
+	case "ackNeeded":
+		if !execution.Challenge.Ack {
+			return ExecutionResult{Status: StatusError, ErrorCode: ErrorChallengeNeeded,
+				Challenge: ChallengeAckNeeded}, false
+		}
+	case "pinNeeded":
+		pin := execution.Challenge.Pin
+		if pin == "" {
+			return ExecutionResult{Status: StatusError, ErrorCode: ErrorChallengeNeeded,
+				Challenge: ChallengePinNeeded}, false
+		}
+		home.deviceLock.Lock()
+		defer home.deviceLock.Unlock()
+		failures := home.pinFailures[id]
+		if failures == nil {
+			failures = &pinFailures{}
+			home.pinFailures[id] = failures
+		}
+		if time.Now().Before(failures.lockedUntil) {
+			log.Printf("PIN for device %s locked out\n", id)
+			return ExecutionResult{Status: StatusError, ErrorCode: ErrorTooManyFailedAttempts}, false
+		}
+		if subtle.ConstantTimeCompare([]byte(pin), []byte(config.Pin)) != 1 {
+			failures.count++
+			log.Printf("Incorrect PIN for device %s, %d in a row\n", id, failures.count)
+			if failures.count >= maxPinFailures {
+				failures.count = 0
+				failures.lockedUntil = time.Now().Add(pinLockout)
+			}
+			return ExecutionResult{Status: StatusError, ErrorCode: ErrorChallengeNeeded,
+				Challenge: ChallengeChallengeFailedPinNeeded}, false
+		}
+		delete(home.pinFailures, id)
+	}
+	return ExecutionResult{}, true
+}
+
+// The Tasmota device behind a Google device id, with the device lock held.
+func (home *Home) lookupDevice(id string) (TasmotaDevice, bool) {
+	address, isLight := splitDeviceId(id)
+	d, ok := home.devices[address]
+	if ok && isLight && !d.IsFan {
+		return TasmotaDevice{}, false
+	}
+	return d, ok
+}
+
+// Send a command to a device and wait for the reply it causes, see OneshotRequest
+// for key and expect. Returns the reply, or the error code if there was none.
+func (home *Home) sendAndWait(ctx context.Context, requestId, id, key, expect string, send func(d *TasmotaDevice)) (NotifyState, IntentErrorCode) {
+	ch := make(chan NotifyState, 1)
+	home.deviceLock.Lock()
+	d, ok := home.lookupDevice(id)
+	if !ok {
+		home.deviceLock.Unlock()
+		return NotifyState{}, ErrorDeviceNotFound
+	}
+	d.OneshotNotify[oneshotKey(requestId, id)] = OneshotRequest{Ch: ch, Id: id, Key: key, Expect: expect,
+		RequestId: requestId}
+	logger.Debug("MQTT command", "requestId", requestId, "device", id, "topic", d.TopicName,
+		"key", key, "expect", expect)
+	start := time.Now()
+	send(&d)
+	home.deviceLock.Unlock()
+
+	updates := home.waitForDevices(ctx, requestId, ch, map[string]bool{id: true})
+	if len(updates) == 0 {
+		metricDeviceTimeouts.Inc("EXECUTE", id)
+		return NotifyState{}, ErrorDeviceOffline
+	}
+	metricDeviceRoundTrip.ObserveSince(start, "EXECUTE", id)
+	if updates[0].Error != "" {
+		return updates[0], TasmotaErrorCode(updates[0].Error)
+	}
+	return updates[0], ""
+}
+
+// Carry out one execution on a device.
+func (home *Home) execute(ctx context.Context, requestId, id string, execution IntentExecuteRequestExecution) ExecutionResult {
+	var update NotifyState
+	var errorCode IntentErrorCode
+
+	if result, ok := home.checkChallenge(id, execution); !ok {
+		return result
+	}
+
+	_, isScene := home.Scenes[id]
+	_, isLight := splitDeviceId(id)
+	home.deviceLock.Lock()
+	d, found := home.lookupDevice(id)
+	home.deviceLock.Unlock()
+	isFan := d.IsFan && !isLight
+	isThermostat := d.IsThermostat() && !isLight
+	isLock := d.IsLock() && !isLight
+	isTimer := strings.HasPrefix(execution.Command, "action.devices.commands.Timer")
+
+	switch {
+	case isScene && execution.Command == "action.devices.commands.ActivateScene":
+		errorCode = home.activateScene(ctx, id, execution.Params.Deactivate)
+	case isScene:
+		errorCode = ErrorFunctionNotSupported
+	case isFan && execution.Command == "action.devices.commands.OnOff":
+		speed := 0
+		if execution.Params.On {
+			speed = d.LastFanSpeed
+			if speed == 0 {
+				speed = 1
+			}
+		}
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "FanSpeed", strconv.Itoa(speed),
+			func(d *TasmotaDevice) { d.SendFanSpeed(ctx, speed) })
+	case isFan && execution.Command == "action.devices.commands.SetFanSpeed":
+		speed, ok := fanSpeedValue(execution.Params.FanSpeed)
+		if !ok {
+			errorCode = ErrorValueOutOfRange
+			break
+		}
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "FanSpeed", strconv.Itoa(speed),
+			func(d *TasmotaDevice) { d.SendFanSpeed(ctx, speed) })
+	case isThermostat && execution.Command == "action.devices.commands.ThermostatSetMode":
+		mode, ok := thermostatModeValue(execution.Params.ThermostatMode)
+		if !ok {
+			errorCode = ErrorValueOutOfRange
+			break
+		}
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "ThermostatModeSet1", strconv.Itoa(mode),
+			func(d *TasmotaDevice) { d.SendThermostatMode(ctx, mode) })
+	case isThermostat && execution.Command == "action.devices.commands.ThermostatTemperatureSetpoint":
+		setpoint := execution.Params.ThermostatTemperatureSetpoint
+		if setpoint < thermostatMinCelsius || setpoint > thermostatMaxCelsius {
+			errorCode = ErrorValueOutOfRange
+			break
+		}
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "TempTargetSet1", formatTemperature(setpoint),
+			func(d *TasmotaDevice) { d.SendTempTarget(ctx, setpoint) })
+	case isThermostat:
+		errorCode = ErrorFunctionNotSupported
+	case isLock && execution.Command == "action.devices.commands.LockUnlock":
+		// unlocking pulses the relay, locking cuts a pulse short
+		On := !execution.Params.Lock
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "POWER", PowerStateString(On),
+			func(d *TasmotaDevice) { d.SendPowerOnOff(ctx, On) })
+	case isLock:
+		errorCode = ErrorFunctionNotSupported
+	case execution.Command == "action.devices.commands.OnOff":
+		On := execution.Params.On
+		update, errorCode = home.sendAndWait(ctx, requestId, id, "POWER", PowerStateString(On),
+			func(d *TasmotaDevice) { d.SendPowerOnOff(ctx, On) })
+	case isTimer && found && (isLight || !d.HasTimer()):
+		// the fan, its light and the thermostat have no Timer trait
+		errorCode = ErrorFunctionNotSupported
+	case execution.Command == "action.devices.commands.TimerStart":
+		errorCode = home.startTimer(id, execution.Params.TimerTimeSec)
+	case execution.Command == "action.devices.commands.TimerAdjust":
+		errorCode = home.adjustTimer(id, execution.Params.TimerTimeSec)
+	case execution.Command == "action.devices.commands.TimerPause":
+		errorCode = home.pauseTimer(id)
+	case execution.Command == "action.devices.commands.TimerResume":
+		errorCode = home.resumeTimer(id)
+	case execution.Command == "action.devices.commands.TimerCancel":
+		errorCode = home.cancelTimer(id)
+	default:
+		errorCode = ErrorFunctionNotSupported
+	}
+
+	switch errorCode {
+	case "":
+		var states IntentExecuteResponseStates
+		states.Online = true
+		states.On = update.PowerState == "ON"
+		if isFan {
+			states.On = update.FanSpeed > 0
+			states.CurrentFanSpeedSetting = fanSpeedName(update.FanSpeed)
+		}
+		if isThermostat {
+			states.On = false
+			states.ThermostatMode = thermostatModeName(update.ThermostatMode)
+			states.ThermostatTemperatureSetpoint = update.TempTarget
+			states.ThermostatTemperatureAmbient = update.TempAmbient
+		}
+		if isLock {
+			states.On = false
+			// the sensor can lag behind the strike opening
+			states.IsLocked = isLockedState(update.IsLocked && execution.Params.Lock)
+		}
+		if isTimer {
+			home.deviceLock.Lock()
+			states.On = home.devices[id].PowerState == "ON"
+			states.TimerRemainingSec, states.TimerPaused = home.timerState(id)
+			home.deviceLock.Unlock()
+		}
+		return ExecutionResult{Status: StatusSuccess, States: states}
+	case ErrorDeviceOffline:
+		return ExecutionResult{Status: StatusOffline, ErrorCode: errorCode}
+	default:
+		return ExecutionResult{Status: StatusError, ErrorCode: errorCode}
+	}
+}
+
+// Carry out executions on one device in the order given, stopping at the first
+// one which fails. The result is that of the last execution attempted. Those
+// left when the deadline of the request has passed aren't sent at all, the
+// device is reported offline.
+func (home *Home) executeAll(ctx context.Context, requestId, id string, executions []IntentExecuteRequestExecution) ExecutionResult {
+	result := ExecutionResult{Status: StatusSuccess}
+	for _, execution := range executions {
+		if ctx.Err() != nil {
+			metricDeviceTimeouts.Inc("EXECUTE", id)
+			return ExecutionResult{Status: StatusOffline, ErrorCode: ErrorDeviceOffline}
+		}
+		result = home.execute(ctx, requestId, id, execution)
+		if result.Status != StatusSuccess {
+			break
+		}
+	}
+	return result
 }
 
-func GenerateExecuteResponse(req IntentExecuteRequest) ([]byte, error) {
+// Google may batch several commands, each for several devices and with several
+// executions, like turning a group of lights on and setting their brightness.
+// Each device gets all the executions meant for it in order, while devices are
+// handled in parallel. They share one deadline, so that a device which doesn't
+// answer can't hold up the response past what Google waits for.
+func (home *Home) GenerateExecuteResponse(ctx context.Context, req IntentExecuteRequest) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, deviceResponseTimeout)
+	defer cancel()
 	var resp IntentExecuteResponse
 	resp.RequestId = req.RequestId
-	responseCh := make(chan NotifyState, len(req.Inputs[0].Payload.Commands[0].Execution))
+	resp.Payload.Commands = []IntentExecuteResponseCommand{}
 
-	// No idea why the struct is defined so deeply nested. In practice, there has
-	// only ever been one Input element, one Commands, and one Execution.
-	n := 0
-	deviceLock.Lock()
+	var ids []string
+	executions := make(map[string][]IntentExecuteRequestExecution)
 	for _, input := range req.Inputs {
 		for _, command := range input.Payload.Commands {
 			for _, device := range command.Devices {
-				for _, execution := range command.Execution {
-					var On bool
-					if execution.Command == "action.devices.commands.OnOff" {
-						if execution.Params.On {
-							On = true
-						} else {
-							On = false
-						}
-					} else {
-						var cmd IntentExecuteResponseCommand
-						cmd.Ids = append(cmd.Ids, device.Id)
-						cmd.Status = "ERROR"
-						cmd.ErrorCode = "Command not supported"
-						resp.Payload.Commands = append(resp.Payload.Commands, cmd)
-						continue
-					}
-
-					var cmd IntentExecuteResponseCommand
-					cmd.Ids = append(cmd.Ids, device.Id)
-					d, ok := devices[device.Id]
-					if !ok {
-						cmd.Status = "OFFLINE"
-						cmd.States.Online = false
-					} else {
-						d.OneshotNotify[req.RequestId] = responseCh
-						d.SendPowerOnOff(On)
-						n = n + 1
-					}
+				if _, ok := executions[device.Id]; !ok {
+					ids = append(ids, device.Id)
 				}
+				executions[device.Id] = append(executions[device.Id], command.Execution...)
 			}
 		}
 	}
-	deviceLock.Unlock()
 
-	for ; n > 0; n-- {
-		update := <-responseCh
+	results := make([]ExecutionResult, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			results[i] = home.executeAll(ctx, req.RequestId, id, executions[id])
+		}(i, id)
+	}
+	wg.Wait()
 
-		var exe IntentExecuteResponseCommand
-		exe.Ids = append(exe.Ids, update.Id)
-		exe.Status = "SUCCESS"
-		exe.States.Online = true
-		if update.PowerState == "ON" {
-			exe.States.On = true
-		} else {
-			exe.States.On = false
+	// one response entry per distinct outcome, in the order devices were requested
+	index := make(map[ExecutionResult]int)
+	for i, id := range ids {
+		n, ok := index[results[i]]
+		if !ok {
+			n = len(resp.Payload.Commands)
+			index[results[i]] = n
+			cmd := IntentExecuteResponseCommand{
+				Status:    results[i].Status,
+				ErrorCode: results[i].ErrorCode,
+			}
+			if cmd.Status == StatusSuccess {
+				states := results[i].States
+				cmd.States = &states
+			}
+			if results[i].Challenge != "" {
+				cmd.ChallengeNeeded = &struct {
+					Type IntentChallengeType `json:"type"`
+				}{results[i].Challenge}
+			}
+			resp.Payload.Commands = append(resp.Payload.Commands, cmd)
 		}
-		resp.Payload.Commands = append(resp.Payload.Commands, exe)
+		resp.Payload.Commands[n].Ids = append(resp.Payload.Commands[n].Ids, id)
 	}
 
 	return json.Marshal(resp)
@@ -257,6 +673,39 @@ func GenerateExecuteResponse(req IntentExecuteRequest) ([]byte, error) {
 
 // -----------------------------------------------------------------------------
 
+// The ids of the devices a QUERY or EXECUTE request is about, for logging.
+func requestDeviceIds(data []byte) []string {
+	var req struct {
+		Inputs []struct {
+			Payload struct {
+				Devices []struct {
+					Id string `json:"id"`
+				} `json:"devices"`
+				Commands []struct {
+					Devices []struct {
+						Id string `json:"id"`
+					} `json:"devices"`
+				} `json:"commands"`
+			} `json:"payload"`
+		} `json:"inputs"`
+	}
+	var ids []string
+	if json.Unmarshal(data, &req) != nil {
+		return ids
+	}
+	for _, input := range req.Inputs {
+		for _, d := range input.Payload.Devices {
+			ids = append(ids, d.Id)
+		}
+		for _, c := range input.Payload.Commands {
+			for _, d := range c.Devices {
+				ids = append(ids, d.Id)
+			}
+		}
+	}
+	return ids
+}
+
 // A JSON struct with just the Intent populated, to figure out what it is. This happens
 // to be identical to the v1 IntentSyncRequest, but we don't want to depend on that.
 type IntentDecoder struct {
@@ -270,9 +719,41 @@ type IntentDecoder struct {
 
 func HandleFulfillment(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	start := time.Now()
+
+	// Metrics are labelled with the intent without its "action.devices." prefix,
+	// and the outcome: ok, or why the request failed as a whole.
+	metricIntent := "none"
+	status := "ok"
+	ctx, span := StartServerSpan(r, "fulfillment")
+	defer func() {
+		metricFulfillmentRequests.Inc(metricIntent, status)
+		metricFulfillmentDuration.ObserveSince(start, metricIntent)
+		span.SetAttributes("intent", metricIntent, "status", status)
+		if status != "ok" {
+			span.SetError(status)
+		}
+		span.Finish()
+	}()
 
-	ok, errorStr := ValidateJWT(r)
-	if !ok {
+	_, jwtSpan := StartSpan(ctx, "validate_jwt", SpanKindInternal)
+	claims, errorStr := ValidateJWT(r)
+	if claims == nil {
+		jwtSpan.SetError(errorStr)
+	}
+	jwtSpan.Finish()
+
+	if isDraining() {
+		// a request on a connection kept alive while shutting down
+		status = "draining"
+		w.Header().Set("Connection", "close")
+		http.Error(w, "503 error, shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if claims == nil {
+		status = "unauthorized"
+		// errorStr only says what was wrong, never the token itself
+		logger.Warn("Fulfillment unauthorized", "reason", errorStr, "remoteAddr", r.RemoteAddr)
 		http.Error(w, errorStr, http.StatusUnauthorized)
 		return
 	}
@@ -280,6 +761,7 @@ func HandleFulfillment(w http.ResponseWriter, r *http.Request) {
 	version, ok := r.Header["google-assistant-api-version"]
 	if ok && len(version) >= 1 {
 		if version[0] != "v1" {
+			status = "unsupported_version"
 			errorStr = "500 error, unimplemented version: " + version[0]
 			http.Error(w, errorStr, http.StatusInternalServerError)
 			return
@@ -288,59 +770,105 @@ func HandleFulfillment(w http.ResponseWriter, r *http.Request) {
 
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		status = "unreadable"
 		http.Error(w, "500 error, cannot read body", http.StatusInternalServerError)
 		return
 	}
-	log.Println("fulfillment req: " + string(data))
 
+	// From here on failures are reported to Google in the payload of a normal
+	// intent response, which it understands better than an HTTP error.
+	var body []byte
 	var intentStruct IntentDecoder
 	err = json.NewDecoder(bytes.NewReader(data)).Decode(&intentStruct)
-	if err != nil || len(intentStruct.Inputs) == 0 {
-		http.Error(w, "No intent string", http.StatusBadRequest)
-		return
+	requestId := intentStruct.RequestId
+	span.SetAttributes("requestId", requestId, "user", claims.Subject)
+	reqLog := logger.With("requestId", requestId, "user", claims.Subject, "traceId", span.TraceIdString())
+	if settings.ProjectId != "" {
+		// lets Cloud Logging show the entries with the trace
+		reqLog = reqLog.With("logging.googleapis.com/trace", "projects/"+settings.ProjectId+"/traces/"+span.TraceIdString())
 	}
-	if len(intentStruct.Inputs) > 1 {
-		http.Error(w, "Only one Input is implemented", http.StatusNotImplemented)
-		return
+	reqLog.Debug("Fulfillment request", "body", redactJSON(data))
+	defer func() {
+		reqLog.Info("Fulfillment", "intent", metricIntent, "status", status,
+			"devices", requestDeviceIds(data),
+			"httpRequest", map[string]string{
+				"requestMethod": r.Method,
+				"requestUrl":    r.URL.Path,
+				"latency":       fmt.Sprintf("%.3fs", time.Since(start).Seconds()),
+			})
+	}()
+	fail := func(code IntentErrorCode, debug string) {
+		status = string(code)
+		body, err = GenerateErrorResponse(requestId, code, debug)
 	}
 
-	intent := intentStruct.Inputs[0].Intent
-	var body []byte
-	if intent == "action.devices.SYNC" {
+	// Everything in the request refers to the devices of the user the access
+	// token was issued to.
+	home, knownUser := HomeForUser(claims.Subject)
+
+	intent := ""
+	if err != nil || len(intentStruct.Inputs) == 0 {
+		fail(ErrorProtocolError, "No intent string")
+	} else if len(intentStruct.Inputs) > 1 {
+		fail(ErrorNotSupported, "Only one Input is implemented")
+	} else if !knownUser {
+		fail(ErrorAuthFailure, "Unknown user")
+	} else if !home.waitReady(ctx, readyTimeout) {
+		// an empty SYNC would remove all devices, unknown ones in a QUERY go offline
+		fail(ErrorTransientError, "Devices not discovered yet")
+	} else {
+		intent = intentStruct.Inputs[0].Intent
+	}
+
+	switch intent {
+	case "":
+		// already answered with an error
+
+	case "action.devices.SYNC":
+		metricIntent = "SYNC"
 		var sync IntentSyncRequest
 		err = json.NewDecoder(bytes.NewReader(data)).Decode(&sync)
 		if err != nil {
-			http.Error(w, "Cannot decode SYNC", http.StatusBadRequest)
+			fail(ErrorProtocolError, "Cannot decode SYNC")
+			break
 		}
 
-		body, err = GenerateSyncResponse(sync)
-	}
+		body, err = home.GenerateSyncResponse(ctx, sync)
 
-	if intent == "action.devices.QUERY" {
+	case "action.devices.QUERY":
+		metricIntent = "QUERY"
 		var query IntentQueryRequest
 		err = json.NewDecoder(bytes.NewReader(data)).Decode(&query)
 		if err != nil {
-			http.Error(w, "Cannot decode QUERY", http.StatusBadRequest)
+			fail(ErrorProtocolError, "Cannot decode QUERY")
+			break
 		}
 
-		body, err = GenerateQueryResponse(query)
-	}
-	if intent == "action.devices.EXECUTE" {
+		body, err = home.GenerateQueryResponse(ctx, query)
+
+	case "action.devices.EXECUTE":
+		metricIntent = "EXECUTE"
 		var execute IntentExecuteRequest
 		err = json.NewDecoder(bytes.NewReader(data)).Decode(&execute)
 		if err != nil {
-			http.Error(w, "Cannot decode EXECUTE", http.StatusBadRequest)
+			fail(ErrorProtocolError, "Cannot decode EXECUTE")
+			break
 		}
 
-		body, err = GenerateExecuteResponse(execute)
+		body, err = home.GenerateExecuteResponse(ctx, execute)
+
+	default:
+		metricIntent = "other"
+		fail(ErrorNotSupported, "Unknown intent "+intent)
 	}
 
 	if err != nil {
+		status = "internal"
 		w.WriteHeader(http.StatusInternalServerError)
 		body = []byte("500 error, JSON serialization failed")
 	}
 	w.Header().Set("Content-Type", "application/json")
-	log.Println("fulfillment response: " + string(body))
+	reqLog.Debug("Fulfillment response", "body", redactJSON(body))
 	w.Write(body)
 	return
 }
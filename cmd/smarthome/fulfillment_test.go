@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Answer commands like Tasmota does, on stat/+/RESULT, and queries with the
+// state on tele/+/STATE or stat/+/STATUS10. Devices whose topic starts with
+// "dead" never answer.
+func simulateTasmota(home *Home, client *fakeClient) {
+	client.reply = func(topic, payload string) {
+		t := strings.Split(strings.TrimPrefix(topic, "/"), "/")
+		if len(t) != 3 || t[0] != "cmnd" || strings.HasPrefix(t[1], "dead") {
+			return
+		}
+		device, command := t[1], t[2]
+		home.deviceLock.Lock()
+		d := home.devices[device]
+		home.deviceLock.Unlock()
+		switch strings.ToUpper(command) {
+		case "POWER":
+			home.deliver("stat/"+device+"/RESULT", fmt.Sprintf(`{"POWER":%q}`, payload))
+		case "FANSPEED":
+			home.deliver("stat/"+device+"/RESULT", fmt.Sprintf(`{"FanSpeed":%s}`, payload))
+		case "THERMOSTATMODESET1", "TEMPTARGETSET1":
+			home.deliver("stat/"+device+"/RESULT", fmt.Sprintf(`{%q:%s}`, command, payload))
+		case "STATE":
+			if d.IsFan {
+				home.deliver("tele/"+device+"/STATE", fmt.Sprintf(`{"POWER1":%q,"FanSpeed":%d}`,
+					d.PowerState, d.FanSpeed))
+				break
+			}
+			home.deliver("tele/"+device+"/STATE", fmt.Sprintf(`{"POWER":%q}`, d.PowerState))
+		case "STATUS":
+			home.deliver("stat/"+device+"/STATUS10", fmt.Sprintf(`{"StatusSNS":{"DS18B20":{"Temperature":21.5},`+
+				`"Thermostat0":{"ThermostatModeSet":%d,"TempTargetSet":%.1f},"Switch1":"ON"}}`,
+				d.ThermostatMode, d.TempTarget))
+		case "DIMMER":
+			home.deliver("stat/"+device+"/RESULT", `{"Command":"Error"}`)
+		default:
+			home.deliver("stat/"+device+"/RESULT", `{"Command":"Unknown"}`)
+		}
+	}
+}
+
+// Make home the only one, and return an access token of its user.
+func setupTestFulfillment(t *testing.T, home *Home) string {
+	t.Helper()
+	setupTestTokens(t)
+	homes = map[string]*Home{home.User: home}
+	now := time.Now()
+	return signTestToken(t, &AccessClaims{jwt.StandardClaims{Audience: "google", Subject: home.User,
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}, fulfillmentScope})
+}
+
+// POST body to /fulfillment, returning the status and the decoded response.
+func fulfill(t *testing.T, ctx context.Context, token, body string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/fulfillment", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	HandleFulfillment(w, r)
+	var resp map[string]interface{}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestFulfillmentErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      string
+		notReady  bool
+		body      string
+		wantCode  string
+		wantHTTP  int
+		wantDebug string
+	}{
+		{"no intent", "", false, `{"requestId":"1","inputs":[]}`, "protocolError", 200, "No intent string"},
+		{"not JSON", "", false, `{"requestId":`, "protocolError", 200, ""},
+		{"two inputs", "", false, `{"requestId":"1","inputs":[{"intent":"action.devices.SYNC"},{"intent":"action.devices.SYNC"}]}`,
+			"notSupported", 200, ""},
+		{"unknown intent", "", false, `{"requestId":"1","inputs":[{"intent":"action.devices.FOO"}]}`,
+			"notSupported", 200, "Unknown intent action.devices.FOO"},
+		{"unknown user", "mallory", false, `{"requestId":"1","inputs":[{"intent":"action.devices.SYNC"}]}`,
+			"authFailure", 200, ""},
+		{"not discovered", "", true, `{"requestId":"1","inputs":[{"intent":"action.devices.SYNC"}]}`,
+			"transientError", 200, "Devices not discovered yet"},
+		{"bad QUERY", "", false, `{"requestId":"1","inputs":[{"intent":"action.devices.QUERY","payload":{"devices":"x"}}]}`,
+			"protocolError", 200, "Cannot decode QUERY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, _ := newTestHome("relay")
+			if tt.notReady {
+				home.readyDone = make(chan struct{})
+			}
+			token := setupTestFulfillment(t, home)
+			if tt.user != "" {
+				token = signTestToken(t, &AccessClaims{jwt.StandardClaims{Audience: "google", Subject: tt.user,
+					IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()}, fulfillmentScope})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			code, resp := fulfill(t, ctx, token, tt.body)
+			if code != tt.wantHTTP {
+				t.Fatalf("HTTP status %d, want %d", code, tt.wantHTTP)
+			}
+			payload := resp["payload"].(map[string]interface{})
+			if payload["errorCode"] != tt.wantCode {
+				t.Errorf("errorCode = %v, want %v", payload["errorCode"], tt.wantCode)
+			}
+			if tt.wantDebug != "" && payload["debugString"] != tt.wantDebug {
+				t.Errorf("debugString = %v, want %v", payload["debugString"], tt.wantDebug)
+			}
+		})
+	}
+}
+
+func TestFulfillmentUnauthorized(t *testing.T) {
+	home, _ := newTestHome("relay")
+	setupTestFulfillment(t, home)
+	code, _ := fulfill(t, context.Background(), "not a token", `{"requestId":"1","inputs":[{"intent":"action.devices.SYNC"}]}`)
+	if code != http.StatusUnauthorized {
+		t.Errorf("HTTP status %d, want 401", code)
+	}
+}
+
+// An EXECUTE with a single command and execution for the device with id.
+func executeRequest(id string, execution string) IntentExecuteRequest {
+	var req IntentExecuteRequest
+	body := fmt.Sprintf(`{"requestId":"r1","inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[
+		{"devices":[{"id":%q}],"execution":[%s]}]}}]}`, id, execution)
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func decodeExecuteResponse(t *testing.T, data []byte) IntentExecuteResponse {
+	t.Helper()
+	var resp IntentExecuteResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestExecuteErrorCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		execution  string
+		wantStatus IntentStatus
+		wantCode   IntentErrorCode
+	}{
+		{"switched on", "relay", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`, StatusSuccess, ""},
+		{"unknown device", "nothing", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			StatusError, ErrorDeviceNotFound},
+		{"no answer", "dead", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			StatusOffline, ErrorDeviceOffline},
+		{"unsupported command", "relay", `{"command":"action.devices.commands.BrightnessAbsolute","params":{}}`,
+			StatusError, ErrorFunctionNotSupported},
+		{"fan speed of a relay", "relay", `{"command":"action.devices.commands.SetFanSpeed","params":{"fanSpeed":"low"}}`,
+			StatusError, ErrorFunctionNotSupported},
+		{"timer too long", "relay", `{"command":"action.devices.commands.TimerStart","params":{"timerTimeSec":100000}}`,
+			StatusError, ErrorValueOutOfRange},
+		{"no timer", "relay", `{"command":"action.devices.commands.TimerCancel","params":{}}`,
+			StatusError, ErrorNoTimerExists},
+		{"light of a relay", "relay-light", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			StatusError, ErrorDeviceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("relay", "dead")
+			simulateTasmota(home, client)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			data, err := home.GenerateExecuteResponse(ctx, executeRequest(tt.id, tt.execution))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := decodeExecuteResponse(t, data)
+			if len(resp.Payload.Commands) != 1 {
+				t.Fatalf("commands = %+v", resp.Payload.Commands)
+			}
+			cmd := resp.Payload.Commands[0]
+			if cmd.Status != tt.wantStatus || cmd.ErrorCode != tt.wantCode {
+				t.Errorf("status %s %s, want %s %s", cmd.Status, cmd.ErrorCode, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestExecuteTimerStart(t *testing.T) {
+	start := `{"command":"action.devices.commands.TimerStart","params":{"timerTimeSec":60}`
+	pin := `,"challenge":{"pin":"1234"}`
+	tests := []struct {
+		name     string
+		id       string
+		wantCode IntentErrorCode
+	}{
+		{"relay", "relay", ""},
+		{"fan", "fan", ErrorFunctionNotSupported},
+		{"light of the fan", "fan-light", ErrorFunctionNotSupported},
+		{"lock", "door", ErrorFunctionNotSupported},
+		{"thermostat", "heater", ErrorFunctionNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("relay", "fan", "door", "heater")
+			home.Devices = map[string]DeviceConfig{
+				"door":   {Type: "lock", Challenge: "pinNeeded", Pin: "1234"},
+				"heater": {Type: "thermostat"},
+			}
+			fan := home.devices["fan"]
+			fan.IsFan = true
+			home.devices["fan"] = fan
+			simulateTasmota(home, client)
+			defer home.stopTimers()
+
+			data, err := home.GenerateExecuteResponse(context.Background(), executeRequest(tt.id, start+pin+`}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := decodeExecuteResponse(t, data).Payload.Commands[0]
+			if cmd.ErrorCode != tt.wantCode {
+				t.Errorf("errorCode %q, want %q", cmd.ErrorCode, tt.wantCode)
+			}
+			home.deviceLock.Lock()
+			_, armed := home.timers[tt.id]
+			home.deviceLock.Unlock()
+			if armed != (tt.wantCode == "") {
+				t.Errorf("timer armed %v", armed)
+			}
+		})
+	}
+}
+
+func TestTasmotaErrorCode(t *testing.T) {
+	tests := []struct {
+		command string
+		want    IntentErrorCode
+	}{
+		{"Unknown", ErrorFunctionNotSupported},
+		{"Error", ErrorHardError},
+	}
+	for _, tt := range tests {
+		if got := TasmotaErrorCode(tt.command); got != tt.want {
+			t.Errorf("TasmotaErrorCode(%q) = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestQueryUnknownDevice(t *testing.T) {
+	home, client := newTestHome("relay")
+	simulateTasmota(home, client)
+	var req IntentQueryRequest
+	body := `{"requestId":"r1","inputs":[{"intent":"action.devices.QUERY","payload":{"devices":[{"id":"nothing"}]}}]}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	data, err := home.GenerateQueryResponse(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Payload.Devices) != 1 || resp.Payload.Devices[0].ErrorCode != ErrorDeviceNotFound {
+		t.Errorf("devices = %+v", resp.Payload.Devices)
+	}
+}
+
+func TestGenerateErrorResponse(t *testing.T) {
+	data, err := GenerateErrorResponse("r1", ErrorAuthFailure, "Unknown user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"requestId":"r1","payload":{"errorCode":"authFailure","debugString":"Unknown user"}}`
+	if string(data) != want {
+		t.Errorf("response = %s, want %s", data, want)
+	}
+}
+
+// The response as "ids status errorCode on", one per command in the response.
+func summarizeExecute(resp IntentExecuteResponse) []string {
+	var summary []string
+	for _, cmd := range resp.Payload.Commands {
+		s := strings.Join(cmd.Ids, ",") + " " + string(cmd.Status)
+		if cmd.ErrorCode != "" {
+			s += " " + string(cmd.ErrorCode)
+		}
+		if cmd.States != nil {
+			s += fmt.Sprintf(" on=%v", cmd.States.On)
+			if cmd.States.CurrentFanSpeedSetting != "" {
+				s += " speed=" + cmd.States.CurrentFanSpeedSetting
+			}
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func TestExecuteMultiple(t *testing.T) {
+	onOff := func(on bool) string {
+		return fmt.Sprintf(`{"command":"action.devices.commands.OnOff","params":{"on":%v}}`, on)
+	}
+	tests := []struct {
+		name          string
+		commands      string // the commands of the request
+		wantResponse  []string
+		wantPublished []string
+	}{
+		{
+			"one command for two devices",
+			`{"devices":[{"id":"relay1"},{"id":"relay2"}],"execution":[` + onOff(true) + `]}`,
+			[]string{"relay1,relay2 SUCCESS on=true"},
+			[]string{"cmnd/relay1/power ON", "cmnd/relay2/power ON"},
+		},
+		{
+			"two commands with different outcomes",
+			`{"devices":[{"id":"relay1"}],"execution":[` + onOff(true) + `]},
+			 {"devices":[{"id":"relay2"}],"execution":[` + onOff(false) + `]}`,
+			[]string{"relay1 SUCCESS on=true", "relay2 SUCCESS on=false"},
+			[]string{"cmnd/relay1/power ON", "cmnd/relay2/power OFF"},
+		},
+		{
+			"executions in order",
+			`{"devices":[{"id":"relay1"}],"execution":[` + onOff(true) + `,` + onOff(false) + `]}`,
+			[]string{"relay1 SUCCESS on=false"},
+			[]string{"cmnd/relay1/power ON", "cmnd/relay1/power OFF"},
+		},
+		{
+			"the same device in two commands",
+			`{"devices":[{"id":"relay1"}],"execution":[` + onOff(false) + `]},
+			 {"devices":[{"id":"relay1"}],"execution":[` + onOff(true) + `]}`,
+			[]string{"relay1 SUCCESS on=true"},
+			[]string{"cmnd/relay1/power OFF", "cmnd/relay1/power ON"},
+		},
+		{
+			"stops at the first failure",
+			`{"devices":[{"id":"relay1"}],"execution":[{"command":"action.devices.commands.Dock"},` + onOff(true) + `]}`,
+			[]string{"relay1 ERROR functionNotSupported"},
+			nil,
+		},
+		{
+			"one device offline",
+			`{"devices":[{"id":"relay1"},{"id":"dead"},{"id":"nothing"}],"execution":[` + onOff(true) + `]}`,
+			[]string{"relay1 SUCCESS on=true", "dead OFFLINE deviceOffline", "nothing ERROR deviceNotFound"},
+			[]string{"cmnd/dead/power ON", "cmnd/relay1/power ON"},
+		},
+		{
+			"fan and its light",
+			`{"devices":[{"id":"fan"}],"execution":[{"command":"action.devices.commands.SetFanSpeed","params":{"fanSpeed":"high"}}]},
+			 {"devices":[{"id":"fan-light"}],"execution":[` + onOff(true) + `]}`,
+			[]string{"fan SUCCESS on=true speed=high", "fan-light SUCCESS on=true"},
+			[]string{"cmnd/fan/FanSpeed 3", "cmnd/fan/power ON"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("relay1", "relay2", "dead", "fan")
+			fan := home.devices["fan"]
+			fan.IsFan = true
+			home.devices["fan"] = fan
+			simulateTasmota(home, client)
+
+			var req IntentExecuteRequest
+			body := `{"requestId":"r1","inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[` +
+				tt.commands + `]}}]}`
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			data, err := home.GenerateExecuteResponse(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := summarizeExecute(decodeExecuteResponse(t, data))
+			if strings.Join(got, "\n") != strings.Join(tt.wantResponse, "\n") {
+				t.Errorf("response:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.wantResponse, "\n"))
+			}
+			// devices are handled in parallel, only the order for each one is known
+			published := client.Published()
+			sort.Strings(published)
+			want := append([]string(nil), tt.wantPublished...)
+			sort.Strings(want)
+			if strings.Join(published, "\n") != strings.Join(want, "\n") {
+				t.Errorf("published:\n%s\nwant:\n%s", strings.Join(published, "\n"), strings.Join(want, "\n"))
+			}
+			// relay1 gets its executions in order, the fan and its light are
+			// two devices handled in parallel
+			var order, wantOrder []string
+			for _, p := range client.Published() {
+				if strings.HasPrefix(p, "cmnd/relay1/") {
+					order = append(order, p)
+				}
+			}
+			for _, p := range tt.wantPublished {
+				if strings.HasPrefix(p, "cmnd/relay1/") {
+					wantOrder = append(wantOrder, p)
+				}
+			}
+			if strings.Join(order, ",") != strings.Join(wantOrder, ",") {
+				t.Errorf("relay1 got %v, want %v", order, wantOrder)
+			}
+		})
+	}
+}
+
+// A device which doesn't answer uses up the deadline of the whole request, its
+// remaining executions aren't sent.
+func TestExecuteSharesDeadline(t *testing.T) {
+	home, client := newTestHome("dead", "relay1")
+	simulateTasmota(home, client)
+	on := `{"command":"action.devices.commands.OnOff","params":{"on":true}}`
+	req := executeRequest("dead", on+","+on+","+on)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	data, err := home.GenerateExecuteResponse(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("took %v with a deadline of 200ms", elapsed)
+	}
+	got := summarizeExecute(decodeExecuteResponse(t, data))
+	if len(got) != 1 || got[0] != "dead OFFLINE deviceOffline" {
+		t.Errorf("response %v", got)
+	}
+	if published := client.Published(); len(published) != 1 {
+		t.Errorf("published %v, want a single command", published)
+	}
+}
+
+func TestExecuteChallenge(t *testing.T) {
+	on := `"command":"action.devices.commands.OnOff","params":{"on":true}`
+	tests := []struct {
+		name          string
+		config        DeviceConfig
+		challenges    []string // of successive requests
+		wantCode      []IntentErrorCode
+		wantChallenge []IntentChallengeType
+	}{
+		{"ack missing", DeviceConfig{Challenge: "ackNeeded"}, []string{`{}`},
+			[]IntentErrorCode{ErrorChallengeNeeded}, []IntentChallengeType{ChallengeAckNeeded}},
+		{"acknowledged", DeviceConfig{Challenge: "ackNeeded"}, []string{`{"ack":true}`},
+			[]IntentErrorCode{""}, []IntentChallengeType{""}},
+		{"pin missing", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"}, []string{`{}`},
+			[]IntentErrorCode{ErrorChallengeNeeded}, []IntentChallengeType{ChallengePinNeeded}},
+		{"pin wrong then right", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"},
+			[]string{`{"pin":"0000"}`, `{"pin":"1234"}`},
+			[]IntentErrorCode{ErrorChallengeNeeded, ""},
+			[]IntentChallengeType{ChallengeChallengeFailedPinNeeded, ""}},
+		{"ack is no pin", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"}, []string{`{"ack":true}`},
+			[]IntentErrorCode{ErrorChallengeNeeded}, []IntentChallengeType{ChallengePinNeeded}},
+		{"locked out", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"},
+			[]string{`{"pin":"0000"}`, `{"pin":"0001"}`, `{"pin":"0002"}`, `{"pin":"0003"}`, `{"pin":"0004"}`,
+				`{"pin":"1234"}`},
+			[]IntentErrorCode{ErrorChallengeNeeded, ErrorChallengeNeeded, ErrorChallengeNeeded,
+				ErrorChallengeNeeded, ErrorChallengeNeeded, ErrorTooManyFailedAttempts},
+			[]IntentChallengeType{ChallengeChallengeFailedPinNeeded, ChallengeChallengeFailedPinNeeded,
+				ChallengeChallengeFailedPinNeeded, ChallengeChallengeFailedPinNeeded,
+				ChallengeChallengeFailedPinNeeded, ""}},
+		{"right pin resets the count", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"},
+			[]string{`{"pin":"0000"}`, `{"pin":"0001"}`, `{"pin":"0002"}`, `{"pin":"0003"}`, `{"pin":"1234"}`,
+				`{"pin":"0004"}`, `{"pin":"1234"}`},
+			[]IntentErrorCode{ErrorChallengeNeeded, ErrorChallengeNeeded, ErrorChallengeNeeded,
+				ErrorChallengeNeeded, "", ErrorChallengeNeeded, ""},
+			[]IntentChallengeType{ChallengeChallengeFailedPinNeeded, ChallengeChallengeFailedPinNeeded,
+				ChallengeChallengeFailedPinNeeded, ChallengeChallengeFailedPinNeeded, "",
+				ChallengeChallengeFailedPinNeeded, ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("relay")
+			home.Devices = map[string]DeviceConfig{"relay": tt.config}
+			simulateTasmota(home, client)
+			for i, challenge := range tt.challenges {
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				data, err := home.GenerateExecuteResponse(ctx, executeRequest("relay", `{`+on+`,"challenge":`+challenge+`}`))
+				cancel()
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp := decodeExecuteResponse(t, data)
+				cmd := resp.Payload.Commands[0]
+				var challengeType IntentChallengeType
+				if cmd.ChallengeNeeded != nil {
+					challengeType = cmd.ChallengeNeeded.Type
+				}
+				if cmd.ErrorCode != tt.wantCode[i] || challengeType != tt.wantChallenge[i] {
+					t.Errorf("request %d: %s %s, want %s %s", i, cmd.ErrorCode, challengeType,
+						tt.wantCode[i], tt.wantChallenge[i])
+				}
+				if (cmd.Status == StatusSuccess) != (tt.wantCode[i] == "") {
+					t.Errorf("request %d: status %s", i, cmd.Status)
+				}
+			}
+			wantPublished := 0
+			for _, code := range tt.wantCode {
+				if code == "" {
+					wantPublished++
+				}
+			}
+			if published := client.Published(); len(published) != wantPublished {
+				t.Errorf("published %v, want %d commands", published, wantPublished)
+			}
+		})
+	}
+}
+
+func TestCheckDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  DeviceConfig
+		wantErr bool
+	}{
+		{"no challenge", DeviceConfig{}, false},
+		{"ack", DeviceConfig{Challenge: "ackNeeded"}, false},
+		{"pin", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"}, false},
+		{"pin missing", DeviceConfig{Challenge: "pinNeeded"}, true},
+		{"unknown challenge", DeviceConfig{Challenge: "retinaScan"}, true},
+		{"lock", DeviceConfig{Type: "lock", Challenge: "pinNeeded", Pin: "1234"}, false},
+		{"lock without a pin", DeviceConfig{Type: "lock", Challenge: "ackNeeded"}, true},
+	}
+	for _, tt := range tests {
+		home := NewHome()
+		home.Devices = map[string]DeviceConfig{"relay": tt.config}
+		if err := home.checkDevices(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkDevices() = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+var startTime = time.Now()
+
+// Liveness: the process is up and serving HTTP. Cloud Run's frontend reserves
+// paths ending in z, so only its startup and liveness probes, which go to the
+// container directly, can reach /healthz and /readyz. From outside / answers the
+// same as /healthz.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"uptimeSec": int(time.Since(startTime).Seconds()),
+	})
+}
+
+type homeReadiness struct {
+	Connected  bool `json:"connected"`
+	Subscribed bool `json:"subscribed"`
+	Discovered bool `json:"discovered"`
+	Devices    int  `json:"devices"`
+}
+
+func (h homeReadiness) ready() bool {
+	return h.Connected && h.Subscribed && h.Discovered
+}
+
+func (home *Home) readiness() homeReadiness {
+	client := home.mqttClient()
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	return homeReadiness{
+		Connected:  client != nil && client.IsConnectionOpen(),
+		Subscribed: home.subscribed,
+		Discovered: home.discovered,
+		Devices:    len(home.devices),
+	}
+}
+
+// Readiness: every home is connected to its broker, subscribed to the topics of
+// its devices and has seen all their retained discovery messages. Answers 503
+// until then and once shutting down, with the state of each home either way.
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	detail := make(map[string]homeReadiness)
+	for user, home := range homes {
+		h := home.readiness()
+		ready = ready && h.ready()
+		detail[user] = h
+	}
+	if isDraining() {
+		ready = false
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "homes": detail})
+}
+
+// Cloud Run stops an idle instance after a while, and with it the MQTT
+// connections whose discovery the next request would have to wait for. Setting
+// min-instances, or a Cloud Scheduler job requesting /, keeps an instance around
+// without anything here. Otherwise KEEP_WARM_URL, the public URL of the service,
+// is requested every KEEP_WARM_INTERVAL (a Go duration, 5m unless set) so that
+// the instance keeps seeing traffic. That only works reliably with CPU always
+// allocated, as the CPU is throttled between requests.
+func StartKeepWarm() {
+	url := settings.KeepWarmURL
+	if url == "" {
+		return
+	}
+	interval := settings.KeepWarmInterval
+	logger.Info("Keeping warm", "url", url, "interval", interval.String())
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	go func() {
+		for range time.Tick(interval) {
+			resp, err := client.Get(url)
+			if err != nil {
+				logger.Warn("Keep warm request failed", "error", err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}()
+}
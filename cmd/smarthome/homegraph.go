@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	homeGraphScope       = "https://www.googleapis.com/auth/homegraph"
+	homeGraphRequestSync = "https://homegraph.googleapis.com/v1/devices:requestSync"
+)
+
+// An access token for the HomeGraph API, of the service account the instance
+// runs as. The HomeGraph API has to be enabled in its project.
+func homeGraphToken() (string, error) {
+	if !settings.Metadata {
+		return "", fmt.Errorf("requesting a SYNC needs the metadata server of Google Cloud, see -metadata")
+	}
+	body := GetMetadata("v1/instance/service-accounts/default/token?scopes=" + homeGraphScope)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("no access token from the metadata server")
+	}
+	return token.AccessToken, nil
+}
+
+// Ask Google to send a SYNC intent for the home soon, after devices were added,
+// removed or had their settings changed.
+// https://developers.google.com/assistant/smarthome/develop/request-sync
+func (home *Home) RequestSync(ctx context.Context) error {
+	_, span := StartSpan(ctx, "homegraph.requestSync", SpanKindClient, "user", home.User)
+	defer span.Finish()
+
+	token, err := homeGraphToken()
+	if err != nil {
+		span.SetError(err.Error())
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{"agentUserId": home.AgentUserId, "async": true})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, homeGraphRequestSync, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("requestSync: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		span.SetError(err.Error())
+		return err
+	}
+	return nil
+}
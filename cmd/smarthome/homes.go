@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// OAuth tokens issued before /authorize had a login page all carry this subject.
+const legacyUserId = "google_smart_home"
+
+// Where to reach the MQTT broker of one home.
+type BrokerConfig struct {
+	Addr     string `json:"addr"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Per-device settings, keyed by device id (the MAC address) in Home.Devices.
+type DeviceConfig struct {
+	// The name shown in Google Home, instead of the FriendlyName from Tasmota.
+	Name string `json:"name,omitempty"`
+	// Expose the device as something discovery can't tell: "thermostat" for
+	// Tasmota's thermostat driver, or "lock" for a relay pulsing a door strike.
+	Type string `json:"type,omitempty"`
+	// For a lock, the input telling whether it is locked, like "Switch1", and
+	// the state it reports when locked, "ON" unless set.
+	LockSensor  string `json:"lockSensor,omitempty"`
+	LockedState string `json:"lockedState,omitempty"`
+	// For a thermostat, the sensor reporting the room temperature, like
+	// "SI7021". The first one in alphabetical order unless set.
+	TempSensor string `json:"tempSensor,omitempty"`
+	// Require the user to confirm ("ackNeeded") or to say a PIN ("pinNeeded")
+	// before Google may send any command to the device.
+	// https://developers.google.com/assistant/smarthome/develop/two-factor-authentication
+	Challenge string `json:"challenge,omitempty"`
+	Pin       string `json:"pin,omitempty"`
+}
+
+// A household served by the bridge: the account which links with Google, the
+// MQTT broker its Tasmota devices talk to, and the devices discovered there.
+type Home struct {
+	User         string `json:"user"`
+	PasswordHash string `json:"passwordHash"` // bcrypt
+	// agentUserId sent in SYNC, which Google uses to tell accounts apart. It has
+	// to stay the same for as long as the account is linked. Defaults to User.
+	AgentUserId string                  `json:"agentUserId"`
+	Broker      BrokerConfig            `json:"mqtt"`
+	Devices     map[string]DeviceConfig `json:"devices"` // guarded by configLock
+	Scenes      map[string]SceneConfig  `json:"scenes"`
+
+	configLock  sync.RWMutex
+	devicesFile string      // where changes to Devices are saved, if anywhere
+	client      mqtt.Client // nil until connected, guarded by clientLock
+	clientLock  sync.Mutex
+	devices     map[string]TasmotaDevice
+	timers      map[string]*deviceTimer // also guarded by deviceLock
+	pinFailures map[string]*pinFailures // by device id, also guarded by deviceLock
+	watchers    map[chan struct{}]bool  // dashboards streaming changes, see notifyWatchers
+	subscribed  bool                    // since the last connect, also guarded by deviceLock
+	resubscribe bool                    // once ConnectMQTT has subscribed
+	discovered  bool                    // all retained discovery messages were received
+	readyDone   chan struct{}           // closed once discovered
+	deviceLock  sync.Mutex
+	readyCh     chan int
+	commandLock sync.Mutex
+	lastCommand map[string]string // by device topic, see sentCommand
+}
+
+// The MQTT client of the home, nil until ConnectMQTT has connected. Publishing
+// with it is fine with deviceLock held.
+func (home *Home) mqttClient() mqtt.Client {
+	home.clientLock.Lock()
+	defer home.clientLock.Unlock()
+	return home.client
+}
+
+// All homes keyed by User, populated by LoadHomes before serving any requests
+// and never modified afterwards.
+var homes = make(map[string]*Home)
+
+func NewHome() *Home {
+	home := &Home{}
+	home.devices = make(map[string]TasmotaDevice)
+	home.timers = make(map[string]*deviceTimer)
+	home.pinFailures = make(map[string]*pinFailures)
+	home.watchers = make(map[chan struct{}]bool)
+	home.readyDone = make(chan struct{})
+	home.readyCh = make(chan int, 1)
+	home.lastCommand = make(map[string]string)
+	return home
+}
+
+// Read the homes from the JSON list in OAUTH_USERS_FILE, for example
+// [{"user":"alice","passwordHash":"$2y$10$...","mqtt":{"addr":"100.64.0.1","port":"1883"},
+//   "devices":{"BCDDC2000000":{"challenge":"pinNeeded","pin":"1234"}},
+//   "scenes":{"movie-night":{"name":"Movie night","activate":[...]}}}]
+// Without OAUTH_USERS_FILE there is a single home configured by OAUTH_USER,
+// OAUTH_PASSWORD_HASH and MQTT_*, with its device settings and scenes in the JSON
+// objects in DEVICES_FILE and SCENES_FILE. It keeps the agentUserId the bridge has
+// always used so existing account links stay valid.
+func LoadHomes() error {
+	filename := settings.UsersFile
+	if filename == "" {
+		home := NewHome()
+		home.User = settings.User
+		home.PasswordHash = settings.PasswordHash
+		home.AgentUserId = AgentUserId
+		home.Broker = BrokerConfig{
+			Addr:     settings.MQTTAddr,
+			Port:     settings.MQTTPort,
+			Username: settings.MQTTUsername,
+			Password: settings.MQTTPassword,
+		}
+		home.devicesFile = settings.DevicesFile
+		err := readJSONFile(home.devicesFile, &home.Devices)
+		if err != nil {
+			return err
+		}
+		err = readJSONFile(settings.ScenesFile, &home.Scenes)
+		if err != nil {
+			return err
+		}
+		err = home.checkDevices()
+		if err != nil {
+			return err
+		}
+		err = home.checkScenes()
+		if err != nil {
+			return err
+		}
+		homes[home.User] = home
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var list []*Home
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	agentIds := make(map[string]bool)
+	for _, h := range list {
+		home := NewHome()
+		home.User = h.User
+		home.PasswordHash = h.PasswordHash
+		home.AgentUserId = h.AgentUserId
+		home.Broker = h.Broker
+		home.Devices = h.Devices
+		home.Scenes = h.Scenes
+		if home.User == "" {
+			return fmt.Errorf("%s: home without a user", filename)
+		}
+		if home.AgentUserId == "" {
+			home.AgentUserId = home.User
+		}
+		if _, ok := homes[home.User]; ok {
+			return fmt.Errorf("%s: duplicate user %q", filename, home.User)
+		}
+		if agentIds[home.AgentUserId] {
+			return fmt.Errorf("%s: duplicate agentUserId %q", filename, home.AgentUserId)
+		}
+		agentIds[home.AgentUserId] = true
+		err = home.checkDevices()
+		if err == nil {
+			err = home.checkScenes()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		homes[home.User] = home
+	}
+	if len(homes) == 0 {
+		return fmt.Errorf("%s: no homes configured", filename)
+	}
+
+	return nil
+}
+
+// Unmarshal the JSON in filename into v, if there is a filename.
+func readJSONFile(filename string, v interface{}) error {
+	if filename == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+func (home *Home) checkDevices() error {
+	for id, config := range home.Devices {
+		err := home.checkDevice(id, config)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (home *Home) checkDevice(id string, config DeviceConfig) error {
+	switch config.Type {
+	case "", "thermostat":
+	case "lock":
+		// anyone who can talk to the Assistant could open the door otherwise
+		if config.Challenge != "pinNeeded" {
+			return fmt.Errorf("lock %s of %q needs a pin", id, home.User)
+		}
+	default:
+		return fmt.Errorf("device %s of %q: unknown type %q", id, home.User, config.Type)
+	}
+	switch config.Challenge {
+	case "", "ackNeeded":
+	case "pinNeeded":
+		if config.Pin == "" {
+			return fmt.Errorf("device %s of %q needs a pin", id, home.User)
+		}
+	default:
+		return fmt.Errorf("device %s of %q: unknown challenge %q", id, home.User, config.Challenge)
+	}
+	if _, ok := home.Scenes[id]; ok {
+		return fmt.Errorf("device %s of %q has the id of a scene", id, home.User)
+	}
+	// activating a scene doesn't ask for the challenge
+	if scene := home.sceneCommanding(id); config.Challenge != "" && scene != "" {
+		return fmt.Errorf("device %s of %q has a challenge, but scene %s sends it commands", id, home.User, scene)
+	}
+	return nil
+}
+
+// The settings configured for a device id, if any.
+func (home *Home) deviceConfig(id string) DeviceConfig {
+	home.configLock.RLock()
+	defer home.configLock.RUnlock()
+	return home.Devices[id]
+}
+
+// Replace the settings of a device, or remove them if config is empty. They are
+// saved to DEVICES_FILE if the home was configured with one, otherwise they only
+// last until the bridge restarts. Returns whether they were saved.
+func (home *Home) setDeviceConfig(id string, config DeviceConfig) (bool, error) {
+	err := home.checkDevice(id, config)
+	if err != nil {
+		return false, err
+	}
+
+	home.configLock.Lock()
+	defer home.configLock.Unlock()
+	devices := make(map[string]DeviceConfig)
+	for k, v := range home.Devices {
+		devices[k] = v
+	}
+	if config == (DeviceConfig{}) {
+		delete(devices, id)
+	} else {
+		devices[id] = config
+	}
+
+	if home.devicesFile != "" {
+		data, err := json.MarshalIndent(devices, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		err = writeFileAtomic(home.devicesFile, append(data, '\n'))
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", home.devicesFile, err)
+		}
+	}
+	home.Devices = devices
+	return home.devicesFile != "", nil
+}
+
+// Replace the file with data, readable only by us, so that a crash or a full
+// disk leaves either the old file or the new one rather than a truncated file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// The home of the user an access token was issued to, the JWT subject.
+func HomeForUser(userID string) (*Home, bool) {
+	home, ok := homes[userID]
+	if !ok && userID == legacyUserId && len(homes) == 1 {
+		for _, h := range homes {
+			return h, true
+		}
+	}
+	return home, ok
+}
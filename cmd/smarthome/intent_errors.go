@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Status of a device in a QUERY or EXECUTE response.
+type IntentStatus string
+
+const (
+	StatusSuccess    IntentStatus = "SUCCESS"
+	StatusPending    IntentStatus = "PENDING"
+	StatusOffline    IntentStatus = "OFFLINE"
+	StatusExceptions IntentStatus = "EXCEPTIONS"
+	StatusError      IntentStatus = "ERROR"
+)
+
+// Error codes Google understands, for a single device or a whole request.
+// https://developers.google.com/assistant/smarthome/reference/errors-exceptions
+type IntentErrorCode string
+
+const (
+	// The device needs two-factor confirmation, see IntentChallengeType. Also
+	// the answer to a wrong PIN, with challengeFailedPinNeeded.
+	ErrorChallengeNeeded IntentErrorCode = "challengeNeeded"
+	// Too many wrong PINs were given for the device, see maxPinFailures.
+	ErrorTooManyFailedAttempts IntentErrorCode = "tooManyFailedAttempts"
+	// The user's account is unknown to us, they have to link it again.
+	ErrorAuthFailure IntentErrorCode = "authFailure"
+	// The device doesn't answer, or Tasmota reported it offline.
+	ErrorDeviceOffline IntentErrorCode = "deviceOffline"
+	// The device id isn't one of the devices we know about.
+	ErrorDeviceNotFound IntentErrorCode = "deviceNotFound"
+	// The device doesn't implement the command, or Tasmota didn't understand it.
+	ErrorFunctionNotSupported IntentErrorCode = "functionNotSupported"
+	// Tasmota understood the command but failed to carry it out.
+	ErrorHardError IntentErrorCode = "hardError"
+	// A TimerAdjust, TimerPause, TimerResume or TimerCancel without a timer running.
+	ErrorNoTimerExists IntentErrorCode = "noTimerExists"
+	// The intent, or the number of inputs in it, isn't something we implement.
+	ErrorNotSupported IntentErrorCode = "notSupported"
+	// The request couldn't be parsed.
+	ErrorProtocolError IntentErrorCode = "protocolError"
+	// Something on our side which may work if tried again, like the MQTT broker.
+	ErrorTransientError IntentErrorCode = "transientError"
+	// A parameter like the duration of a timer is outside what we support.
+	ErrorValueOutOfRange IntentErrorCode = "valueOutOfRange"
+)
+
+// What Google has to ask the user before a command is carried out.
+// https://developers.google.com/assistant/smarthome/develop/two-factor-authentication
+type IntentChallengeType string
+
+const (
+	ChallengeAckNeeded                IntentChallengeType = "ackNeeded"
+	ChallengePinNeeded                IntentChallengeType = "pinNeeded"
+	ChallengeChallengeFailedPinNeeded IntentChallengeType = "challengeFailedPinNeeded"
+)
+
+// The response to any intent when the whole request failed, rather than some of
+// the devices in it. Google reads errorCode from the payload in this case.
+type IntentErrorResponse struct {
+	RequestId string `json:"requestId"`
+	Payload   struct {
+		ErrorCode   IntentErrorCode `json:"errorCode"`
+		DebugString string          `json:"debugString,omitempty"`
+	} `json:"payload"`
+}
+
+func GenerateErrorResponse(requestId string, code IntentErrorCode, debug string) ([]byte, error) {
+	var resp IntentErrorResponse
+	resp.RequestId = requestId
+	resp.Payload.ErrorCode = code
+	resp.Payload.DebugString = debug
+	return json.Marshal(resp)
+}
+
+// The error code for a command Tasmota rejected, given its "Command" reply.
+func TasmotaErrorCode(command string) IntentErrorCode {
+	if command == "Unknown" {
+		return ErrorFunctionNotSupported
+	}
+	return ErrorHardError
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Keys used to sign and verify our OAuth access tokens.
+//
+// OAUTH_JWT_SIGNING_KEY is an RSA or EC private key in PEM format, either the PEM
+// text itself or the name of a file containing it. Tokens are signed with RS256
+// or ES256/384/512 accordingly, with a "kid" header identifying the key.
+//
+// OAUTH_JWT_VERIFY_KEYS is a comma separated list of further public keys whose
+// tokens are still accepted. To rotate keys, add the public half of the current
+// signing key here and switch OAUTH_JWT_SIGNING_KEY to the new one: tokens signed
+// by the old key keep working until they expire, and the old key can be dropped
+// from the list once AccessTokenExp has passed.
+//
+// Without OAUTH_JWT_SIGNING_KEY tokens are signed with HS512 using the shared
+// secret OAUTH_JWT_KEY, as they always have been. While OAUTH_JWT_KEY is set,
+// HMAC signed tokens are accepted too.
+type JWTKeys struct {
+	SigningKID    string
+	SigningPEM    []byte
+	SigningMethod jwt.SigningMethod
+
+	signingKey   interface{} // *rsa.PrivateKey, *ecdsa.PrivateKey or HMAC []byte
+	hmacKey      []byte
+	verification map[string]interface{} // *rsa.PublicKey or *ecdsa.PublicKey, by kid
+}
+
+var jwtKeys *JWTKeys
+
+// The PEM text of a key given in the environment, either directly or by filename.
+func readPEM(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+func parsePublicKeyPEM(pem []byte) (interface{}, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("not an RSA or EC public key")
+}
+
+func LoadJWTKeys() (*JWTKeys, error) {
+	keys := &JWTKeys{verification: make(map[string]interface{})}
+	keys.hmacKey = []byte(settings.JWTKey)
+
+	signing := settings.JWTSigningKey
+	if signing == "" {
+		if len(keys.hmacKey) == 0 {
+			return nil, fmt.Errorf("neither OAUTH_JWT_SIGNING_KEY nor OAUTH_JWT_KEY is set")
+		}
+		keys.SigningPEM = keys.hmacKey
+		keys.SigningMethod = jwt.SigningMethodHS512
+		keys.signingKey = keys.hmacKey
+	} else {
+		pem, err := readPEM(signing)
+		if err != nil {
+			return nil, fmt.Errorf("OAUTH_JWT_SIGNING_KEY: %v", err)
+		}
+		var public interface{}
+		if key, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+			public = &key.PublicKey
+			keys.signingKey = key
+			keys.SigningMethod = jwt.SigningMethodRS256
+		} else if key, err := jwt.ParseECPrivateKeyFromPEM(pem); err == nil {
+			public = &key.PublicKey
+			keys.signingKey = key
+			switch key.Curve {
+			case elliptic.P256():
+				keys.SigningMethod = jwt.SigningMethodES256
+			case elliptic.P384():
+				keys.SigningMethod = jwt.SigningMethodES384
+			case elliptic.P521():
+				keys.SigningMethod = jwt.SigningMethodES512
+			default:
+				return nil, fmt.Errorf("OAUTH_JWT_SIGNING_KEY: unsupported curve")
+			}
+		} else {
+			return nil, fmt.Errorf("OAUTH_JWT_SIGNING_KEY: not an RSA or EC private key")
+		}
+		keys.SigningPEM = pem
+		keys.SigningKID = keyID(public)
+		keys.verification[keys.SigningKID] = public
+	}
+
+	for _, value := range strings.Split(settings.JWTVerifyKeys, ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		pem, err := readPEM(value)
+		if err != nil {
+			return nil, fmt.Errorf("OAUTH_JWT_VERIFY_KEYS: %v", err)
+		}
+		public, err := parsePublicKeyPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("OAUTH_JWT_VERIFY_KEYS: %v", err)
+		}
+		keys.verification[keyID(public)] = public
+	}
+
+	return keys, nil
+}
+
+// The jwt.Keyfunc used to verify access tokens. The key is chosen by the "kid"
+// header and has to match the type of the signing method, so that a token can't
+// pick HS256 and have it checked against the bytes of an RSA public key.
+func (keys *JWTKeys) Keyfunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(keys.hmacKey) == 0 {
+			return nil, fmt.Errorf("HMAC signed tokens are not accepted")
+		}
+		return keys.hmacKey, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, ok := keys.verification[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown JWT key id %q", kid)
+	}
+	switch t.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("JWT signing method %v does not match key %q", t.Header["alg"], kid)
+}
+
+// A secret shared by all instances for signing our own short lived values like
+// login tickets and dashboard sessions, derived from whichever key signs access
+// tokens. Rotating that key invalidates them all, so users signed in to the
+// dashboard have to sign in again, while access tokens signed with the old key
+// stay valid as long as it is in OAUTH_JWT_VERIFY_KEYS.
+func (keys *JWTKeys) SecretKey(purpose string) []byte {
+	h := sha256.New()
+	h.Write([]byte(purpose))
+	h.Write(keys.SigningPEM)
+	return h.Sum(nil)
+}
+
+// https://tools.ietf.org/html/rfc7517#section-4
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func base64Int(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func publicJWK(key interface{}) JWK {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Alg: "RS256",
+			N: base64Int(k.N, 0), E: base64Int(big.NewInt(int64(k.E)), 0)}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk := JWK{Kty: "EC", Crv: k.Curve.Params().Name,
+			X: base64Int(k.X, size), Y: base64Int(k.Y, size)}
+		switch k.Curve.Params().BitSize {
+		case 256:
+			jwk.Alg = "ES256"
+		case 384:
+			jwk.Alg = "ES384"
+		case 521:
+			jwk.Alg = "ES512"
+		}
+		return jwk
+	}
+	return JWK{}
+}
+
+// The RFC 7638 thumbprint of a public key, used as its "kid". It only depends on
+// the key itself, so every instance derives the same id without configuration.
+func keyID(key interface{}) string {
+	jwk := publicJWK(key)
+	var canonical string
+	if jwk.Kty == "RSA" {
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			jwk.Crv, jwk.X, jwk.Y)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Serve the public keys in verification as a JWK Set, for anyone who wants to
+// check our tokens without sharing a secret with us.
+func (keys *JWTKeys) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	set.Keys = []JWK{}
+	for kid, key := range keys.verification {
+		jwk := publicJWK(key)
+		jwk.Kid = kid
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A relay configured as "type":"lock" drives an electric door strike. Tasmota
+// is expected to have PulseTime set, so that unlocking switches the relay on
+// for a moment and the strike locks again by itself.
+// https://developers.google.com/assistant/smarthome/traits/lockunlock
+func (device *TasmotaDevice) IsLock() bool {
+	return device.Config().Type == "lock"
+}
+
+// Whether the door is locked: the state of the configured LockSensor input, if
+// the device has reported it, otherwise whether the relay is off.
+func (device *TasmotaDevice) IsLocked() bool {
+	config := device.Config()
+	if config.LockSensor != "" {
+		if state, ok := device.Switches[config.LockSensor]; ok {
+			locked := config.LockedState
+			if locked == "" {
+				locked = "ON"
+			}
+			return state == locked
+		}
+	}
+	return device.PowerState != "ON"
+}
+
+// Pick the state of switch inputs out of a Tasmota message, either
+// {"Switch1":"ON"} in sensor status or {"Switch1":{"Action":"ON"}} in a RESULT.
+// What was found is added to values for listeners.
+func parseSwitches(device *TasmotaDevice, jsonMap map[string]interface{}, values map[string]string) {
+	for key, value := range jsonMap {
+		if !strings.HasPrefix(key, "Switch") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(key, "Switch")); err != nil {
+			// SwitchMode1, SwitchText1 and the like
+			continue
+		}
+		state, ok := value.(string)
+		if m, isMap := value.(map[string]interface{}); isMap {
+			state, ok = m["Action"].(string)
+		}
+		if ok {
+			device.Switches[key] = state
+			values[key] = state
+		}
+	}
+}
+
+// isLocked is reported as false as well as true, so it can't be omitempty.
+var lockedTrue, lockedFalse = true, false
+
+func isLockedState(locked bool) *bool {
+	if locked {
+		return &lockedTrue
+	}
+	return &lockedFalse
+}
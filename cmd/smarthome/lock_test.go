@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIsLocked(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   DeviceConfig
+		power    string
+		switches map[string]string
+		want     bool
+	}{
+		{"relay off", DeviceConfig{Type: "lock"}, "OFF", nil, true},
+		{"relay pulsing", DeviceConfig{Type: "lock"}, "ON", nil, false},
+		{"sensor closed", DeviceConfig{Type: "lock", LockSensor: "Switch1"}, "ON", map[string]string{"Switch1": "ON"}, true},
+		{"sensor open", DeviceConfig{Type: "lock", LockSensor: "Switch1"}, "OFF", map[string]string{"Switch1": "OFF"}, false},
+		{"sensor inverted", DeviceConfig{Type: "lock", LockSensor: "Switch1", LockedState: "OFF"}, "ON",
+			map[string]string{"Switch1": "OFF"}, true},
+		{"sensor not reported", DeviceConfig{Type: "lock", LockSensor: "Switch2"}, "OFF",
+			map[string]string{"Switch1": "OFF"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, _ := newTestHome("door")
+			home.Devices = map[string]DeviceConfig{"door": tt.config}
+			d := home.devices["door"]
+			d.PowerState = tt.power
+			for k, v := range tt.switches {
+				d.Switches[k] = v
+			}
+			if got := d.IsLocked(); got != tt.want {
+				t.Errorf("IsLocked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSwitches(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    map[string]string
+	}{
+		{`{"Switch1":"ON","Switch2":"OFF"}`, map[string]string{"Switch1": "ON", "Switch2": "OFF"}},
+		{`{"Switch1":{"Action":"OFF"}}`, map[string]string{"Switch1": "OFF"}},
+		{`{"SwitchMode1":0,"SwitchText1":"door"}`, map[string]string{}},
+	}
+	for _, tt := range tests {
+		d := NewDevice(nil)
+		var jsonMap map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.payload), &jsonMap); err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]string)
+		parseSwitches(&d, jsonMap, values)
+		if len(values) != len(tt.want) || len(d.Switches) != len(tt.want) {
+			t.Errorf("%s: values %v, switches %v, want %v", tt.payload, values, d.Switches, tt.want)
+		}
+		for k, v := range tt.want {
+			if values[k] != v || d.Switches[k] != v {
+				t.Errorf("%s: %s = %q, want %q", tt.payload, k, values[k], v)
+			}
+		}
+	}
+}
+
+func TestLockExecute(t *testing.T) {
+	pin := `,"challenge":{"pin":"1234"}`
+	tests := []struct {
+		name          string
+		execution     string
+		wantCode      IntentErrorCode
+		wantLocked    bool
+		wantPublished string
+	}{
+		{"unlock", `{"command":"action.devices.commands.LockUnlock","params":{"lock":false}` + pin + `}`,
+			"", false, "cmnd/door/power ON"},
+		{"lock", `{"command":"action.devices.commands.LockUnlock","params":{"lock":true}` + pin + `}`,
+			"", true, "cmnd/door/power OFF"},
+		{"no pin", `{"command":"action.devices.commands.LockUnlock","params":{"lock":false}}`,
+			ErrorChallengeNeeded, false, ""},
+		{"not a switch", `{"command":"action.devices.commands.OnOff","params":{"on":true}` + pin + `}`,
+			ErrorFunctionNotSupported, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("door")
+			home.Devices = map[string]DeviceConfig{"door": {Type: "lock", Challenge: "pinNeeded", Pin: "1234"}}
+			simulateTasmota(home, client)
+			data, err := home.GenerateExecuteResponse(context.Background(), executeRequest("door", tt.execution))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := decodeExecuteResponse(t, data).Payload.Commands[0]
+			if cmd.ErrorCode != tt.wantCode {
+				t.Errorf("errorCode %q, want %q", cmd.ErrorCode, tt.wantCode)
+			}
+			if tt.wantCode == "" && (cmd.States == nil || cmd.States.IsLocked == nil || *cmd.States.IsLocked != tt.wantLocked) {
+				t.Errorf("states %+v, want isLocked %v", cmd.States, tt.wantLocked)
+			}
+			published := strings.Join(client.Published(), ",")
+			if published != tt.wantPublished {
+				t.Errorf("published %q, want %q", published, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestLockSyncAndQuery(t *testing.T) {
+	settings = &Config{}
+	home, client := newTestHome("door")
+	home.Devices = map[string]DeviceConfig{"door": {Type: "lock", Challenge: "pinNeeded", Pin: "1234"}}
+	simulateTasmota(home, client)
+
+	d := home.devices["door"]
+	sync := d.ToIntentSyncResponseDevice()
+	if sync.Type != "action.devices.types.LOCK" || strings.Join(sync.Traits, ",") != "action.devices.traits.LockUnlock" {
+		t.Errorf("SYNC device %+v", sync)
+	}
+
+	var query IntentQueryRequest
+	if err := json.Unmarshal([]byte(`{"requestId":"r1","inputs":[{"intent":"action.devices.QUERY",
+		"payload":{"devices":[{"id":"door"}]}}]}`), &query); err != nil {
+		t.Fatal(err)
+	}
+	data, err := home.GenerateQueryResponse(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Payload.Devices) != 1 || resp.Payload.Devices[0].IsLocked == nil || !*resp.Payload.Devices[0].IsLocked {
+		t.Errorf("QUERY of a lock: %+v", resp.Payload.Devices)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Structured logging, one JSON object per line as Cloud Logging reads them
+// from stdout: https://cloud.google.com/logging/docs/structured-logging
+// Fields like requestId and device are added with With, so that everything
+// logged about one fulfillment request can be found by its requestId.
+//
+// LOG_LEVEL sets the lowest severity logged, INFO unless set. Fulfillment
+// request and response bodies and MQTT traffic are logged at DEBUG.
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityDebug:
+		return "DEBUG"
+	case SeverityInfo:
+		return "INFO"
+	case SeverityWarning:
+		return "WARNING"
+	}
+	return "ERROR"
+}
+
+type Logger struct {
+	fields []interface{} // alternating keys and values
+}
+
+// The root logger, without any fields.
+var logger = &Logger{}
+
+var (
+	logLevel            = SeverityInfo
+	logOutput io.Writer = os.Stdout
+	logMutex  sync.Mutex
+)
+
+// Make the standard log package, which most of the bridge and its libraries
+// use, write structured INFO entries too. Called first thing in main.
+func SetupLogging() {
+	log.SetFlags(0)
+	log.SetOutput(logWriter{severity: SeverityInfo})
+}
+
+// A *log.Logger writing entries of one severity, for libraries like paho.
+func NewStdLogger(severity Severity, component string) *log.Logger {
+	return log.New(logWriter{severity: severity, component: component}, "", 0)
+}
+
+type logWriter struct {
+	severity  Severity
+	component string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	l := logger
+	if w.component != "" {
+		l = l.With("component", w.component)
+	}
+	l.log(w.severity, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// A logger adding fields, given as alternating keys and values, to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(SeverityDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(SeverityInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(SeverityWarning, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(SeverityError, msg, kv) }
+
+func (l *Logger) Enabled(severity Severity) bool {
+	return severity >= logLevel
+}
+
+func (l *Logger) log(severity Severity, msg string, kv []interface{}) {
+	if !l.Enabled(severity) {
+		return
+	}
+	entry := map[string]interface{}{
+		"severity": severity.String(),
+		"message":  msg,
+		"time":     time.Now().Format(time.RFC3339Nano),
+	}
+	all := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i+1 < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		value := all[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"severity":"ERROR","message":%q}`, "unloggable entry: "+msg))
+	}
+	logMutex.Lock()
+	logOutput.Write(append(line, '\n'))
+	logMutex.Unlock()
+}
+
+// Keys whose values never appear in logs, compared case insensitively.
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"token":         true,
+	"client_secret": true,
+	"password":      true,
+	"pin":           true, // from the challenge of an EXECUTE
+}
+
+// A JSON body with the values of redactedKeys replaced, for logging. Bodies
+// which aren't JSON are only logged by length.
+func redactJSON(data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(data))
+	}
+	return redactValue(v)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range value {
+			if redactedKeys[strings.ToLower(k)] {
+				value[k] = "REDACTED"
+			} else {
+				value[k] = redactValue(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range value {
+			value[i] = redactValue(inner)
+		}
+	}
+	return v
+}
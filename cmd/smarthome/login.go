@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	csrfCookieName = "smarthome_csrf"
+
+	// How long the user has between logging in and answering the consent screen.
+	loginTicketExp = 5 * time.Minute
+)
+
+// The OAuth parameters Google sends to /authorize, carried through the login
+// and consent forms so that HandleAuthorizeRequest sees them on the final POST.
+var authorizeParams = []string{"client_id", "redirect_uri", "response_type", "state", "scope"}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<html>
+<head><title>Smart Home sign in</title></head>
+<body>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="POST">
+{{range $key, $val := .Params}}<input type="hidden" name="{{$key}}" value="{{$val}}">
+{{end}}<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{if .Ticket}}<input type="hidden" name="ticket" value="{{.Ticket}}">
+<p>Allow Google Smart Home to see and control the devices of <strong>{{.User}}</strong>?</p>
+<button type="submit" name="action" value="allow">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+{{else}}<input type="hidden" name="action" value="login">
+<p><label>Username <input type="text" name="username" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<button type="submit">Sign in</button>
+{{end}}</form>
+</body>
+</html>`))
+
+type loginPage struct {
+	Params map[string]string
+	CSRF   string
+	Error  string
+	Ticket string
+	User   string
+}
+
+// After maxLoginFailures wrong passwords in a row for a user from one address no
+// password is accepted for them from there until loginLockout has passed, on
+// /authorize and the dashboard alike. Counting by address as well keeps someone
+// guessing from elsewhere from locking the user out of their own account. Like
+// failed PINs, the count is kept by each instance.
+const (
+	maxLoginFailures = 5
+	loginLockout     = 15 * time.Minute
+)
+
+var (
+	loginFailuresLock sync.Mutex
+	loginFailures     = make(map[loginClient]*pinFailures)
+)
+
+type loginClient struct {
+	user string
+	ip   string
+}
+
+// The address a request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Compared against for unknown users, so that they take as long to reject as a
+// wrong password and the time taken doesn't tell which users exist.
+const dummyPasswordHash = "$2a$10$5niAXzoZhrP8klxYQ4SSHeTPd5S0zTZx53yl0Hi8jGaUtnc8CmI.e"
+
+// Each home has an account allowed to link with Google, the password is a
+// bcrypt hash as produced by `htpasswd -nbB user password`.
+func checkPassword(user, ip, password string) bool {
+	home, ok := homes[user]
+	if !ok || user == "" || home.PasswordHash == "" {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return false
+	}
+	if loginLockedOut(user, ip) {
+		return false
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(home.PasswordHash), []byte(password)) == nil
+
+	loginFailuresLock.Lock()
+	defer loginFailuresLock.Unlock()
+	client := loginClient{user, ip}
+	if ok {
+		delete(loginFailures, client)
+		return true
+	}
+	failures := loginFailures[client]
+	if failures == nil {
+		failures = &pinFailures{}
+		loginFailures[client] = failures
+	}
+	failures.count++
+	if failures.count >= maxLoginFailures {
+		log.Printf("Password of user %q locked out for %s after %d failures\n", user, ip, failures.count)
+		failures.count = 0
+		failures.lockedUntil = time.Now().Add(loginLockout)
+	}
+	return false
+}
+
+// Whether too many wrong passwords were given for the user from ip lately.
+func loginLockedOut(user, ip string) bool {
+	loginFailuresLock.Lock()
+	defer loginFailuresLock.Unlock()
+	failures := loginFailures[loginClient{user, ip}]
+	return failures != nil && time.Now().Before(failures.lockedUntil)
+}
+
+// Double-submit CSRF protection: the token is both in a cookie and in the form,
+// and a cross-site POST can't read the cookie to fill in the form. Nothing is
+// stored server side, so any Cloud Run instance can check it.
+// The cookie is only sent to pages under path.
+func csrfToken(w http.ResponseWriter, r *http.Request, path string) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("crypto/rand failed: %v", err)
+	}
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     path,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue("csrf"))) == 1
+}
+
+// A login ticket records that the user entered the right password, so that the
+// consent screen doesn't have to ask again. It is signed with a key derived from
+// the JWT key and bound to the CSRF token, there is no session state to share
+// between instances.
+func signLoginTicket(user, csrf string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." +
+		strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + loginTicketMAC(payload, csrf)
+}
+
+func loginTicketMAC(payload, csrf string) string {
+	mac := hmac.New(sha256.New, jwtKeys.SecretKey("login ticket"))
+	mac.Write([]byte(payload + "." + csrf))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyLoginTicket(ticket, csrf string) (string, bool) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(loginTicketMAC(payload, csrf))) {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, page loginPage) {
+	page.Params = make(map[string]string)
+	for _, p := range authorizeParams {
+		if v := r.FormValue(p); v != "" {
+			page.Params[p] = v
+		}
+	}
+	page.CSRF = csrfToken(w, r, "/authorize")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if err := loginTemplate.Execute(w, page); err != nil {
+		log.Println("Login template failed: " + err.Error())
+	}
+}
+
+// UserAuthorizationHandler for the OAuth server. A GET shows the login form, the
+// POST of the login form shows the consent screen, and only once the user allows
+// access from the consent screen do we return a userID so that
+// HandleAuthorizeRequest issues an authorization code. Returning an empty userID
+// and no error tells the OAuth server that we've written the response ourselves.
+func HandleUserAuthorization(w http.ResponseWriter, r *http.Request) (userID string, err error) {
+	if r.Method != http.MethodPost {
+		renderLogin(w, r, loginPage{})
+		return "", nil
+	}
+
+	if !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return "", nil
+	}
+	csrf := r.PostFormValue("csrf")
+
+	switch r.PostFormValue("action") {
+	case "login":
+		user := r.PostFormValue("username")
+		if loginLockedOut(user, clientIP(r)) {
+			log.Printf("Login for user %q locked out for %s\n", user, clientIP(r))
+			renderLogin(w, r, loginPage{Error: "Too many failed attempts, please try again later"})
+			return "", nil
+		}
+		if !checkPassword(user, clientIP(r), r.PostFormValue("password")) {
+			log.Printf("Login failed for user %q\n", user)
+			renderLogin(w, r, loginPage{Error: "Incorrect username or password"})
+			return "", nil
+		}
+		ticket := signLoginTicket(user, csrf, time.Now().Add(loginTicketExp))
+		renderLogin(w, r, loginPage{Ticket: ticket, User: user})
+		return "", nil
+
+	case "allow", "deny":
+		user, ok := verifyLoginTicket(r.PostFormValue("ticket"), csrf)
+		if !ok {
+			renderLogin(w, r, loginPage{Error: "Your sign in has expired, please try again"})
+			return "", nil
+		}
+		if r.PostFormValue("action") == "deny" {
+			return "", errors.ErrAccessDenied
+		}
+		log.Printf("User %q authorized %q\n", user, r.FormValue("client_id"))
+		return user, nil
+	}
+
+	http.Error(w, "Unknown action", http.StatusBadRequest)
+	return "", nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A home for alice with password "secret", and no failed logins.
+func setupTestLogin(t *testing.T) {
+	t.Helper()
+	setupTestTokens(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := NewHome()
+	home.User = "alice"
+	home.PasswordHash = string(hash)
+	homes = map[string]*Home{"alice": home}
+	loginFailuresLock.Lock()
+	loginFailures = make(map[loginClient]*pinFailures)
+	loginFailuresLock.Unlock()
+}
+
+func TestCheckPasswordLockout(t *testing.T) {
+	setupTestLogin(t)
+	const ip, otherIP = "192.0.2.1", "198.51.100.7"
+	steps := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"bob", "secret", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		// a right password starts the count again
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		{"alice", "wrong", false},
+		// locked out, even with the right password
+		{"alice", "secret", false},
+	}
+	for i, s := range steps {
+		if got := checkPassword(s.user, ip, s.password); got != s.want {
+			t.Fatalf("step %d: checkPassword(%q, %q) = %v, want %v", i, s.user, s.password, got, s.want)
+		}
+	}
+	if !loginLockedOut("alice", ip) || loginLockedOut("bob", ip) {
+		t.Errorf("alice locked out %v, bob %v", loginLockedOut("alice", ip), loginLockedOut("bob", ip))
+	}
+	// guessing from one address doesn't lock alice out everywhere
+	if loginLockedOut("alice", otherIP) || !checkPassword("alice", otherIP, "secret") {
+		t.Errorf("alice locked out from %s", otherIP)
+	}
+
+	loginFailuresLock.Lock()
+	loginFailures[loginClient{"alice", ip}].lockedUntil = time.Now().Add(-time.Second)
+	loginFailuresLock.Unlock()
+	if !checkPassword("alice", ip, "secret") {
+		t.Errorf("still locked out after loginLockout")
+	}
+}
+
+func TestCheckPasswordUnknownUser(t *testing.T) {
+	setupTestLogin(t)
+	// unknown users cost a bcrypt comparison like everyone else
+	if cost, err := bcrypt.Cost([]byte(dummyPasswordHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummyPasswordHash cost %d, %v", cost, err)
+	}
+	for _, user := range []string{"bob", ""} {
+		if checkPassword(user, "192.0.2.1", "no user has this password") {
+			t.Errorf("checkPassword(%q) accepted", user)
+		}
+	}
+}
+
+func TestDashboardLoginLockout(t *testing.T) {
+	setupTestLogin(t)
+	login := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		form := url.Values{"csrf": {"token"}, "username": {"alice"}, "password": {password}}
+		r := httptest.NewRequest("POST", "/dashboard/login", strings.NewReader(form.Encode()))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token"})
+		w := httptest.NewRecorder()
+		HandleDashboardLogin(w, r)
+		return w
+	}
+	for i := 0; i < maxLoginFailures; i++ {
+		if w := login("192.0.2.1:1234", "wrong"); !strings.Contains(w.Body.String(), "Incorrect username or password") {
+			t.Fatalf("attempt %d: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	w := login("192.0.2.1:5678", "secret")
+	if !strings.Contains(w.Body.String(), "Too many failed attempts") {
+		t.Errorf("after %d failures: %d %s", maxLoginFailures, w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			t.Errorf("session cookie set while locked out")
+		}
+	}
+
+	// alice, signing in from home, still can
+	w = login("198.51.100.7:1234", "secret")
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("from another address: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,48 +11,90 @@ import (
 
 const AgentUserId = string("https://github.com/DentonGentry/g_assist_mqtt.git")
 
+// Access to '/' is not used in the actual application. It used to be delayed to
+// keep Cloud Run from stopping the instance, see StartKeepWarm instead.
 func HandleRoot(w http.ResponseWriter, r *http.Request) {
-	// Access to '/' is not used in the actual appication, only for Google Cloud Run
-	// checking if we're alive. We delay the response so that Cloud Run will let us
-	// live a bit longer.
-	time.Sleep(2 * time.Second)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	HandleHealthz(w, r)
 }
 
 func main() {
-	// Google Cloud Run will populate PORT automatically.
-	portStr := os.Getenv("PORT")
-	if portStr == "" {
-		portStr = "8080"
+	SetupLogging()
+	var err error
+	settings, err = LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Configuration: %v", err)
 	}
+	logLevel = settings.LogLevel
+	settings.resolve()
+	SetupTracing()
 
 	mux := http.NewServeMux()
 	srv := &http.Server{
-		Addr:         ":" + portStr,
+		Addr:         ":" + settings.Port,
 		Handler:      mux,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
-	mux.HandleFunc("/quitquitquit", func(w http.ResponseWriter, r *http.Request) {
-		srv.Shutdown(context.Background())
-	})
-	mux.HandleFunc("/debug", HandleDebug)
+	shutdownDone := make(chan struct{})
+	HandleSignals(srv, shutdownDone)
+	mux.HandleFunc("/quitquitquit", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		// srv.Shutdown waits for this request too, so it can't be called from here
+		beginShutdown(srv, shutdownDone)
+	}))
+	mux.HandleFunc("/metrics", RequireAdmin(HandleMetrics))
+	mux.HandleFunc("/api/", RequireAdmin(HandleAPI))
+	mux.HandleFunc("/dashboard", HandleDashboard)
+	mux.HandleFunc("/dashboard/login", HandleDashboardLogin)
+	mux.HandleFunc("/dashboard/logout", HandleDashboardLogout)
+	mux.HandleFunc("/dashboard/power", HandleDashboardPower)
+	mux.HandleFunc("/dashboard/events", HandleDashboardEvents)
+	mux.HandleFunc("/healthz", HandleHealthz)
+	mux.HandleFunc("/readyz", HandleReadyz)
 	mux.HandleFunc("/", HandleRoot)
 
 	fmt.Println("Initializing fulfillment")
 	mux.HandleFunc("/fulfillment", HandleFulfillment)
 
-	fmt.Println("Starting MQTT client")
-	MQTT()
+	err = LoadHomes()
+	if err != nil {
+		log.Fatalf("Loading homes failed: %v", err)
+	}
 
 	fmt.Println("Initializing OAuth server")
 	SetupOauth(mux)
 
-	log.Println("MQTT Devices:")
-	deviceLock.Lock()
-	for _, d := range devices {
-		log.Println(d)
-	}
-	deviceLock.Unlock()
+	// Connect in the background, linking accounts and refreshing tokens need no
+	// MQTT while fulfillment waits for it, see Home.waitReady.
+	go func() {
+		fmt.Println("Starting MQTT client")
+		MQTT()
+
+		for _, home := range homes {
+			log.Printf("MQTT Devices for %q:\n", home.User)
+			home.deviceLock.Lock()
+			for _, d := range home.devices {
+				log.Println(d)
+			}
+			home.deviceLock.Unlock()
+		}
+	}()
 
-	log.Fatal(srv.ListenAndServe())
+	StartKeepWarm()
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics served on /metrics in the Prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+// Only counters, gauges and histograms with a few labels are needed, which is
+// simple enough not to pull in the Prometheus client library. The labels name
+// users and the MAC addresses of devices, so scraping needs the admin token or
+// an address in ADMIN_ALLOWED_IPS.
+var (
+	metricFulfillmentRequests = newCounterVec("smarthome_fulfillment_requests_total",
+		"Fulfillment requests by intent and outcome.", "intent", "status")
+	metricFulfillmentDuration = newHistogramVec("smarthome_fulfillment_duration_seconds",
+		"Time taken to answer fulfillment requests.", latencyBuckets, "intent")
+	metricDeviceRoundTrip = newHistogramVec("smarthome_device_roundtrip_seconds",
+		"Time from sending a device a command or query until it answered.", latencyBuckets, "intent", "device")
+	metricDeviceTimeouts = newCounterVec("smarthome_device_timeouts_total",
+		"Devices which didn't answer a command or query in time.", "intent", "device")
+	metricMQTTConnected = newGaugeVec("smarthome_mqtt_connected",
+		"Whether the MQTT client of a home is connected.", "user")
+	metricMQTTConnects = newCounterVec("smarthome_mqtt_connects_total",
+		"Connections made to the MQTT broker of a home, including reconnects.", "user")
+	metricMQTTConnectionsLost = newCounterVec("smarthome_mqtt_connections_lost_total",
+		"Connections to the MQTT broker of a home which were lost.", "user")
+	metricMQTTMessages = newCounterVec("smarthome_mqtt_messages_total",
+		"MQTT messages received by topic class.", "user", "class")
+)
+
+// Fulfillment requests and device replies are expected to take between a few
+// milliseconds and deviceResponseTimeout.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+type metricBase struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+}
+
+// The label values of one series, joined to be used as a map key.
+func (m *metricBase) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s: %d label values for %d labels", m.name, len(values), len(m.labels)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Label values escape only backslash, double quote and line feed, unlike %q.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// Format the labels of a series, with an extra label like le appended.
+func (m *metricBase) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(m.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, labelPair(m.labels[i], v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, labelPair(extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricBase) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterVec struct {
+	metricBase
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{metricBase: metricBase{name: name, help: help, labels: labels},
+		values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, c.labelString(k), c.values[k])
+	}
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{counterVec{metricBase: metricBase{name: name, help: help, labels: labels},
+		values: make(map[string]float64)}}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gaugeVec) Set(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w, "gauge")
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, g.labelString(k), g.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	metricBase
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{metricBase: metricBase{name: name, help: help, labels: labels},
+		buckets: buckets, values: make(map[string]*histogram)}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", fmt.Sprintf("%g", le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, h.labelString(k), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(k), hist.count)
+	}
+}
+
+// The number of devices discovered in each home, read when scraped.
+func writeDeviceCounts(w io.Writer) {
+	fmt.Fprintf(w, "# HELP smarthome_devices Devices discovered over MQTT.\n# TYPE smarthome_devices gauge\n")
+	users := make([]string, 0, len(homes))
+	for user := range homes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		home := homes[user]
+		home.deviceLock.Lock()
+		n := len(home.devices)
+		home.deviceLock.Unlock()
+		fmt.Fprintf(w, "smarthome_devices{%s} %d\n", labelPair("user", user), n)
+	}
+}
+
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+	writeDeviceCounts(w)
+}
+
+// The label for the topic of a message received from a broker.
+func topicClass(topic string) string {
+	t := strings.Split(topic, "/")
+	switch {
+	case len(t) == 4 && t[0] == "tasmota" && t[1] == "discovery":
+		return "discovery"
+	case len(t) == 3 && t[0] == "stat":
+		return "stat_" + strings.ToLower(t[2])
+	case len(t) == 3 && t[0] == "tele":
+		return "tele_" + strings.ToLower(t[2])
+	case len(t) == 3 && t[0] == "tmp":
+		return "ready"
+	}
+	return "other"
+}
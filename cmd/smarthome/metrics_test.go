@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLabelString(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "alice", `{user="alice"}`},
+		{"quote", `say "hi"`, `{user="say \"hi\""}`},
+		{"backslash", `a\b`, `{user="a\\b"}`},
+		{"newline", "a\nb", `{user="a\nb"}`},
+		// %q would escape these, Prometheus takes them as they are
+		{"utf-8", "zoë", `{user="zoë"}`},
+		{"tab", "a\tb", "{user=\"a\tb\"}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metricBase{name: "test", labels: []string{"user"}}
+			if got := m.labelString(m.key([]string{tt.value})); got != tt.want {
+				t.Errorf("labelString(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterWrite(t *testing.T) {
+	c := &counterVec{metricBase: metricBase{name: "test_total", help: "Test.", labels: []string{"intent", "status"}},
+		values: make(map[string]float64)}
+	c.Inc("QUERY", "SUCCESS")
+	c.Inc("QUERY", "SUCCESS")
+	c.Inc("EXECUTE", "ERROR")
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{intent="EXECUTE",status="ERROR"} 1
+test_total{intent="QUERY",status="SUCCESS"} 2
+`
+	if buf.String() != want {
+		t.Errorf("write =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
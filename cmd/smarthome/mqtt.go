@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,35 +27,71 @@ const (
 // State extracted from tasmota/discovery/*/config events, used to construct
 // a Smart Home Sync response
 type TasmotaDevice struct {
-	MacAddress    string
-	IP            string
-	FriendlyName  string
-	Hostname      string
-	Hardware      string
-	Software      string
-	HasRelays     bool
-	HasOnOff      bool
-	TopicName     string
-	PowerState    string
-	OneshotNotify map[string]chan NotifyState
+	MacAddress     string
+	IP             string
+	FriendlyName   string
+	Hostname       string
+	Hardware       string
+	Software       string
+	HasRelays      bool
+	HasOnOff       bool
+	TopicName      string
+	PowerState     string
+	IsFan          bool // a Sonoff iFan, see lightIdSuffix
+	FanSpeed       int
+	LastFanSpeed   int  // the last speed other than off
+	HasThermostat  bool // reported Thermostat0, see IsThermostat
+	ThermostatMode int
+	TempTarget     float64
+	TempAmbient    float64
+	Switches       map[string]string         // states of inputs like Switch1, see IsLocked
+	Online         bool                      // per the LWT, or because it sent something
+	LastSeen       time.Time                 // of the last message on stat/ or tele/
+	RSSI           int                       // Wi-Fi quality in percent
+	Signal         int                       // Wi-Fi signal in dBm
+	OneshotNotify  map[string]OneshotRequest // keyed by oneshotKey
+
+	home *Home
 }
 
 // Notification sent to listeners upon receiving a state change from a device.
 // The listener transforms this into a Query response or Execute response.
 type NotifyState struct {
-	Id         string
-	PowerState string
+	Id             string
+	PowerState     string
+	FanSpeed       int
+	ThermostatMode int
+	TempTarget     float64
+	TempAmbient    float64
+	IsLocked       bool
+	Error          string // Tasmota's "Command" value if it rejected our command
 }
 
-var client mqtt.Client
-var devices = make(map[string]TasmotaDevice)
-var deviceLock sync.Mutex
-var readyCh chan int
-var ProjectId string
+// A listener waiting for the next state reported by a device. If Expect is set
+// the listener is only notified by a stat/+/RESULT reporting that value for Key
+// (POWER unless set) or a Tasmota error answering the command Key, so that
+// periodic tele/+/STATE messages, someone pressing the button on the device or
+// another command failing are not mistaken for the reply to our command. Id is
+// the Google device id notified, the MAC address unless set.
+type OneshotRequest struct {
+	Ch        chan NotifyState
+	Id        string
+	Key       string
+	Expect    string
+	RequestId string // to correlate the reply in logs
+}
+
+// The key in OneshotNotify of the listener for a device id in a request. An iFan
+// is two devices in Google's eyes, which may be in the same request.
+func oneshotKey(requestId, id string) string {
+	return requestId + "/" + id
+}
 
-func NewDevice() TasmotaDevice {
+func NewDevice(home *Home) TasmotaDevice {
 	var device TasmotaDevice
-	device.OneshotNotify = make(map[string]chan NotifyState)
+	device.OneshotNotify = make(map[string]OneshotRequest)
+	device.Switches = make(map[string]string)
+	device.home = home
 	return device
 }
 
@@ -70,18 +107,61 @@ func (device *TasmotaDevice) ToIntentSyncResponseDevice() IntentSyncResponseDevi
 	if device.HasOnOff {
 		sync.Traits = append(sync.Traits, "action.devices.traits.OnOff")
 	}
+	if device.HasTimer() {
+		// see deviceTimer
+		sync.Traits = append(sync.Traits, "action.devices.traits.Timer")
+		sync.Attributes = &IntentSyncResponseAttributes{MaxTimerLimitSec: maxTimerSec}
+	}
+	if device.IsFan {
+		// relay 1 is ToIntentSyncResponseLight, OnOff is the fan
+		sync.Type = "action.devices.types.FAN"
+		sync.Traits = []string{"action.devices.traits.OnOff", "action.devices.traits.FanSpeed"}
+		sync.Attributes = &IntentSyncResponseAttributes{AvailableFanSpeeds: fanSpeedAttributes()}
+	}
+	if device.IsThermostat() {
+		// the relay is driven by the thermostat, not switched by us
+		sync.Type = "action.devices.types.THERMOSTAT"
+		sync.Traits = []string{"action.devices.traits.TemperatureSetting"}
+		sync.Attributes = thermostatAttributes()
+	}
+	if device.IsLock() {
+		sync.Type = "action.devices.types.LOCK"
+		sync.Traits = []string{"action.devices.traits.LockUnlock"}
+		sync.Attributes = nil
+	}
 	sync.Name.DefaultNames = append(sync.Name.DefaultNames, device.Hardware)
-	sync.Name.Name = device.FriendlyName
+	sync.Name.Name = device.Name()
 	sync.WillReportState = false
 	sync.DeviceInfo.Manufacturer = "Tasmota"
 	sync.DeviceInfo.Model = device.Hardware
 	sync.DeviceInfo.SwVersion = device.Software
-	sync.OtherDeviceIds.AgentId = ProjectId
+	sync.OtherDeviceIds.AgentId = settings.ProjectId
 	sync.OtherDeviceIds.DeviceId = device.Hostname
 
 	return sync
 }
 
+// The settings configured for the device, if any.
+func (device *TasmotaDevice) Config() DeviceConfig {
+	if device.home == nil {
+		return DeviceConfig{}
+	}
+	return device.home.deviceConfig(device.MacAddress)
+}
+
+// The name of the device in Google Home.
+func (device *TasmotaDevice) Name() string {
+	if name := device.Config().Name; name != "" {
+		return name
+	}
+	return device.FriendlyName
+}
+
+// Whether the Timer trait, which switches the relay off, is available.
+func (device *TasmotaDevice) HasTimer() bool {
+	return device.HasRelays && device.HasOnOff && !device.IsFan && !device.IsThermostat() && !device.IsLock()
+}
+
 // Produce the Device portion of a Google Smart Home Query Response
 // https://developers.google.com/assistant/smarthome/reference/intent/query
 func (device *TasmotaDevice) ToIntentQueryResponseDevice() IntentQueryResponseDevice {
@@ -99,36 +179,97 @@ func (device *TasmotaDevice) ToIntentQueryResponseDevice() IntentQueryResponseDe
 }
 
 // to be called from fulfillment goroutines to send an MQTT query for the state of a device.
-func SendQuery(topic string) {
+func (home *Home) SendQuery(ctx context.Context, topic string) {
+	span := startPublishSpan(ctx, topic)
+	defer span.Finish()
 	retained := false
-	token := client.Publish(topic, AtLeastOnce, retained, "QUERY")
+	token := home.mqttClient().Publish(topic, AtLeastOnce, retained, "QUERY")
 	_ = token.Wait()
 	if token.Error() != nil {
-		log.Printf("DeviceQuery: client.Publish failed: %q\n", token.Error())
+		span.SetError(token.Error().Error())
+		logger.Error("DeviceQuery: client.Publish failed", "user", home.User, "topic", topic,
+			"error", token.Error())
 	}
 }
 
-// to be called from fulfillment goroutines to control the state of the device.
-func (device *TasmotaDevice) SendPowerOnOff(On bool) {
-	var state string
+// Tasmota's POWER value for an OnOff state.
+func PowerStateString(On bool) string {
 	if On {
-		state = "ON"
-	} else {
-		state = "OFF"
+		return "ON"
 	}
+	return "OFF"
+}
+
+// to be called from fulfillment goroutines to control the state of the device.
+func (device *TasmotaDevice) SendPowerOnOff(ctx context.Context, On bool) {
+	state := PowerStateString(On)
 
 	topic := "cmnd/" + device.TopicName + "/power"
+	span := startPublishSpan(ctx, topic)
+	device.home.sentCommand(device.TopicName, "POWER")
 	retained := false
-	token := client.Publish(topic, ExactlyOnce, retained, state)
+	token := device.home.mqttClient().Publish(topic, ExactlyOnce, retained, state)
 	go func() {
+		defer span.Finish()
 		_ = token.Wait()
 		if token.Error() != nil {
-			log.Printf("DeviceExecute: client.Publish failed: %q\n", token.Error())
+			span.SetError(token.Error().Error())
+			logger.Error("DeviceExecute: client.Publish failed", "user", device.home.User,
+				"device", device.MacAddress, "topic", topic, "error", token.Error())
 			return
 		}
 	}()
 }
 
+// Publish a Tasmota command to the device without waiting for the broker, as
+// SendPowerOnOff does.
+func (device *TasmotaDevice) sendCommand(ctx context.Context, command, payload string) {
+	topic := "cmnd/" + device.TopicName + "/" + command
+	span := startPublishSpan(ctx, topic)
+	device.home.sentCommand(device.TopicName, command)
+	retained := false
+	token := device.home.mqttClient().Publish(topic, ExactlyOnce, retained, payload)
+	go func() {
+		defer span.Finish()
+		_ = token.Wait()
+		if token.Error() != nil {
+			span.SetError(token.Error().Error())
+			logger.Error("DeviceExecute: client.Publish failed", "user", device.home.User,
+				"device", device.MacAddress, "topic", topic, "error", token.Error())
+		}
+	}()
+}
+
+// Publish any Tasmota command to a device, like Dimmer or Color, and wait until
+// the broker has it. Tasmota's reply is not waited for.
+func (home *Home) SendCommand(ctx context.Context, topic, command, payload string) error {
+	span := startPublishSpan(ctx, "cmnd/"+topic+"/"+command)
+	defer span.Finish()
+	home.sentCommand(topic, command)
+	retained := false
+	token := home.mqttClient().Publish("cmnd/"+topic+"/"+command, ExactlyOnce, retained, payload)
+	_ = token.Wait()
+	if token.Error() != nil {
+		span.SetError(token.Error().Error())
+		return fmt.Errorf("%s %s: client.Publish failed: %v", topic, command, token.Error())
+	}
+	return nil
+}
+
+// Remember the command last published to the device with topic. Tasmota handles
+// commands one at a time, and an error on its stat/+/RESULT answers this one.
+func (home *Home) sentCommand(topic, command string) {
+	home.commandLock.Lock()
+	home.lastCommand[topic] = command
+	home.commandLock.Unlock()
+}
+
+func (home *Home) lastCommandTo(topic string) string {
+	home.commandLock.Lock()
+	defer home.commandLock.Unlock()
+	return home.lastCommand[topic]
+}
+
 // Parse JSON received on tasmota/discovery/*/config
 // {"ip":"10.1.10.100",
 //  "dn":"Tasmota",
@@ -187,39 +328,110 @@ func parseTasmotaDiscovery(device *TasmotaDevice, jsonStr []byte) error {
 	}
 
 	device.TopicName = jsonMap["t"].(string)
+	device.IsFan = isIFan(device.Hardware)
 	return nil
 }
 
 // handles /stat/device-topic/RESULT and /tele/device-topic/STATE messages
-// serialized through SerializeDevicesFunc
+// serialized through SerializeDevicesFunc. isResult is true for stat/+/RESULT,
+// which is where Tasmota replies to commands we send it.
 //
 // Example (both topics send the same message format):
 // {"Time":"2021-03-28T14:46:16","Uptime":"21T16:41:40","UptimeSec":1874500,"Heap":29,
 //  "SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":20,"POWER":"OFF",
 //  "Wifi":{"AP":2,"SSId":"MY-SSID","BSSId":"00:11:22:33:44:55","Channel":1,"RSSI":44,
 //          "Signal":-78,"LinkCount":17,"Downtime":"0T00:05:18"}}
-func parseTasmotaResult(device *TasmotaDevice, jsonStr []byte) error {
+//
+// Devices with several relays, like an iFan, report POWER1 instead of POWER and
+// iFans add "FanSpeed":0-3. Sensors are reported on tele/+/SENSOR, and in
+// "StatusSNS" on stat/+/STATUS10, see parseThermostat.
+//
+// A command Tasmota cannot carry out is answered on stat/+/RESULT with
+// {"Command":"Error"} or {"Command":"Unknown"}.
+func parseTasmotaResult(device *TasmotaDevice, jsonStr []byte, isResult bool) error {
 	jsonMap := make(map[string]interface{})
 	err := json.Unmarshal(jsonStr, &jsonMap)
 	if err != nil {
 		return err
 	}
 
-	device.PowerState = jsonMap["POWER"].(string)
+	if sns, ok := jsonMap["StatusSNS"].(map[string]interface{}); ok {
+		jsonMap = sns
+	}
+
+	values := make(map[string]string)
+	parseThermostat(device, jsonMap, values)
+	parseSwitches(device, jsonMap, values)
+	power, hasPower := jsonMap["POWER"].(string)
+	if !hasPower {
+		power, hasPower = jsonMap["POWER1"].(string)
+	}
+	if hasPower {
+		device.PowerState = power
+		values["POWER"] = power
+	}
+	if wifi, ok := jsonMap["Wifi"].(map[string]interface{}); ok {
+		if rssi, ok := wifi["RSSI"].(float64); ok {
+			device.RSSI = int(rssi)
+		}
+		if signal, ok := wifi["Signal"].(float64); ok {
+			device.Signal = int(signal)
+		}
+	}
+	if speed, ok := jsonMap["FanSpeed"].(float64); ok {
+		device.FanSpeed = int(speed)
+		if device.FanSpeed > 0 {
+			device.LastFanSpeed = device.FanSpeed
+		}
+		values["FanSpeed"] = strconv.Itoa(device.FanSpeed)
+	}
+	command, _ := jsonMap["Command"].(string)
+	isError := isResult && (command == "Error" || command == "Unknown")
+	if len(values) == 0 && !isError {
+		// a RESULT for some other command, like a Dimmer or Status reply
+		return nil
+	}
+	answered := ""
+	if isError && device.home != nil {
+		// Tasmota doesn't say which command failed, it is the last one it got
+		answered = device.home.lastCommandTo(device.TopicName)
+	}
 
-	update := NotifyState{Id: device.MacAddress, PowerState: device.PowerState}
-	for key, ch := range device.OneshotNotify {
-		ch <- update
+	for key, req := range device.OneshotNotify {
+		k := req.Key
+		if k == "" {
+			k = "POWER"
+		}
+		value, ok := values[k]
+		if isError && !strings.EqualFold(answered, k) {
+			continue
+		}
+		if req.Expect != "" && !(isResult && (isError || (ok && value == req.Expect))) {
+			continue
+		}
+		update := NotifyState{Id: req.Id, PowerState: device.PowerState, FanSpeed: device.FanSpeed,
+			ThermostatMode: device.ThermostatMode, TempTarget: device.TempTarget,
+			TempAmbient: device.TempAmbient, IsLocked: device.IsLocked()}
+		if update.Id == "" {
+			update.Id = device.MacAddress
+		}
+		if isError {
+			update.Error = command
+		}
+		logger.Debug("MQTT reply", "requestId", req.RequestId, "device", update.Id,
+			"values", values, "error", update.Error)
+		req.Ch <- update
 		delete(device.OneshotNotify, key)
 	}
 
 	return nil
 }
 
-func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
+func (home *Home) mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	metricMQTTMessages.Inc(home.User, topicClass(msg.Topic()))
 	t := strings.Split(msg.Topic(), "/")
-	deviceLock.Lock()
-	defer deviceLock.Unlock()
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
 
 	if len(t) == 4 && t[0] == "tasmota" && t[1] == "discovery" {
 		if t[3] != "config" {
@@ -228,41 +440,57 @@ func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
 		}
 
 		address := t[2]
-		device := NewDevice()
+		device := NewDevice(home)
 		err := parseTasmotaDiscovery(&device, msg.Payload())
 		if err != nil {
-			log.Println("parseTasmotaDiscovery failed: " + string(msg.Payload()))
+			logger.Warn("parseTasmotaDiscovery failed", "user", home.User, "topic", msg.Topic(),
+				"payload", string(msg.Payload()), "error", err)
 			return
 		}
-		devices[address] = device
+		home.devices[address] = device
+		home.notifyWatchers()
 
 		topic := "/cmnd/" + device.TopicName + "/STATE"
 		go func() {
 			// fetch current state immediately
-			SendQuery(topic)
+			home.SendQuery(context.Background(), topic)
 		}()
-	} else if len(t) >= 3 && ((t[0] == "stat" && t[2] == "RESULT") || (t[0] == "tele" && t[2] == "STATE")) {
+	} else if len(t) >= 3 && ((t[0] == "stat" && (t[2] == "RESULT" || t[2] == "STATUS10")) ||
+		(t[0] == "tele" && (t[2] == "STATE" || t[2] == "SENSOR"))) {
 		address := t[1]
-		device, ok := devices[address]
+		device, ok := home.devices[address]
 		if ok {
-			err := parseTasmotaResult(&device, msg.Payload())
+			device.Online = true
+			device.LastSeen = time.Now()
+			isResult := t[0] == "stat" && t[2] == "RESULT"
+			err := parseTasmotaResult(&device, msg.Payload(), isResult)
 			if err != nil {
-				log.Println("parseTasmotaResult failed: " + string(msg.Payload()))
+				logger.Warn("parseTasmotaResult failed", "user", home.User, "device", device.MacAddress,
+					"topic", msg.Topic(), "payload", string(msg.Payload()), "error", err)
 				return
 			}
-			devices[address] = device
+			home.devices[address] = device
+			home.notifyWatchers()
 		} else {
 			// a device we are ignoring
 		}
+	} else if len(t) == 3 && t[0] == "tele" && t[2] == "LWT" {
+		// "Online", or "Offline" published by the broker when the device is gone
+		device, ok := home.devices[t[1]]
+		if ok {
+			device.Online = string(msg.Payload()) == "Online"
+			home.devices[t[1]] = device
+			home.notifyWatchers()
+		}
 	} else if len(t) == 3 && t[0] == "tmp" && t[2] == "READY" {
 		// This is our own message, sent during init and intended as a signal
 		// that we've received all retained messages on other topics.
-		readyCh <- 1
+		home.readyCh <- 1
 	}
 }
 
 func DefaultMessageHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Println("DefaultMessageHandler unexpected topic: " + msg.Topic())
+	logger.Warn("DefaultMessageHandler unexpected topic", "topic", msg.Topic())
 }
 
 func OnConnectHandler(client mqtt.Client) {
@@ -270,7 +498,7 @@ func OnConnectHandler(client mqtt.Client) {
 }
 
 func ConnectionLostHandler(client mqtt.Client, err error) {
-	log.Printf("MQTT connection lost: %v", err)
+	logger.Warn("MQTT connection lost", "error", err)
 }
 
 func HashString(s string) string {
@@ -280,18 +508,20 @@ func HashString(s string) string {
 }
 
 // Make one attempt to connect to the MQTT broker. Expected to be called from a loop.
-func ConnectToMQTT(slug string) (client mqtt.Client, err error) {
+// user labels the metrics of the connection, onConnect is called on every connect
+// including reconnects.
+func ConnectToMQTT(config BrokerConfig, slug string, user string, onConnect func()) (client mqtt.Client, err error) {
 	opts := mqtt.NewClientOptions()
 
-	addr := os.Getenv("MQTT_IP_ADDR")
+	addr := config.Addr
 	ip, err := netaddr.ParseIP(addr)
 	if err == nil && ip.Is6() {
 		addr = "[" + addr + "]"
 	}
-	broker := "mqtt://" + addr + ":" + os.Getenv("MQTT_PORT")
+	broker := "mqtt://" + addr + ":" + config.Port
 	opts.AddBroker(broker)
-	opts.SetUsername(os.Getenv("MQTT_USERNAME"))
-	opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
 
 	// improve average latency by allowing packets to arrive out of order.
 	// everything we do is stateless, operations cannot depend on previous ops.
@@ -313,8 +543,18 @@ func ConnectToMQTT(slug string) (client mqtt.Client, err error) {
 	opts.SetPingTimeout(30 * time.Second)
 
 	opts.SetDefaultPublishHandler(DefaultMessageHandler)
-	opts.OnConnect = OnConnectHandler
-	opts.OnConnectionLost = ConnectionLostHandler
+	opts.OnConnect = func(client mqtt.Client) {
+		OnConnectHandler(client)
+		metricMQTTConnected.Set(1, user)
+		metricMQTTConnects.Inc(user)
+		onConnect()
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		ConnectionLostHandler(client, err)
+		metricMQTTConnected.Set(0, user)
+		metricMQTTConnectionsLost.Inc(user)
+	}
+	metricMQTTConnected.Set(0, user)
 
 	client = mqtt.NewClient(opts)
 	token := client.Connect()
@@ -327,61 +567,107 @@ func ConnectToMQTT(slug string) (client mqtt.Client, err error) {
 }
 
 func GetMetadata(urlPath string) string {
-	client := &http.Client{}
+	client := &http.Client{Timeout: 5 * time.Second}
 	url := "http://metadata.google.internal/computeMetadata/" + urlPath
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Printf("Unable to allocate http.NewRequest: %q\n", err)
+		logger.Error("Unable to allocate http.NewRequest", "url", url, "error", err)
 		return ""
 	}
 	req.Header.Set("Metadata-Flavor", "Google")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("HTTP GET failed: %q\n", err)
+		logger.Warn("Metadata HTTP GET failed", "url", url, "error", err)
 		return ""
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("HTTP GET ReadAll failed: %q\n", err)
+		logger.Warn("Metadata HTTP GET ReadAll failed", "url", url, "error", err)
 		return ""
 	}
 
 	return string(body)
 }
 
-func MQTT() {
-	ProjectId = GetMetadata("v1/project/project-id")
-	InstanceId := GetMetadata("v1/instance/id")
-	slug := HashString(InstanceId)
-	readyCh = make(chan int, 1)
-	mqtt.ERROR = log.New(os.Stdout, "[MQTT ERROR] ", 0)
-	mqtt.CRITICAL = log.New(os.Stdout, "[MQTT CRIT] ", 0)
-	mqtt.WARN = log.New(os.Stdout, "[MQTT WARN]  ", 0)
-	//mqtt.DEBUG = log.New(os.Stdout, "[MQTT DEBUG] ", 0) // quite verbose
-
-	var err error
-	for client, err = ConnectToMQTT(slug); err != nil; {
-		time.Sleep(1 * time.Second)
-	}
-
-	readyTopic := "tmp/" + slug + "/READY"
+// Subscribe to the topics the bridge follows, retrying until it worked. Retained
+// messages like discovery are sent again.
+func (home *Home) subscribe(readyTopic string) {
 	for {
 		topics := map[string]byte{
 			"tasmota/discovery/#": AtLeastOnce,
 			"stat/+/RESULT":       AtLeastOnce,
 			"tele/+/STATE":        AtLeastOnce,
+			"tele/+/SENSOR":       AtLeastOnce,
+			"stat/+/STATUS10":     AtLeastOnce,
+			"tele/+/LWT":          AtLeastOnce,
 			readyTopic:            AtLeastOnce,
 		}
-		token := client.SubscribeMultiple(topics, mqttMessageHandler)
+		token := home.mqttClient().SubscribeMultiple(topics, home.mqttMessageHandler)
 		token.Wait()
 		if token.Error() == nil {
 			break
 		}
 		time.Sleep(1 * time.Second)
 	}
-	log.Println("Subscribed to MQTT Topics")
+	home.deviceLock.Lock()
+	home.subscribed = true
+	home.deviceLock.Unlock()
+	log.Printf("Subscribed to MQTT Topics for %q\n", home.User)
+}
+
+// Wait until the devices of the home are discovered, for at most timeout. During
+// a cold start fulfillment requests arrive before that.
+func (home *Home) waitReady(ctx context.Context, timeout time.Duration) bool {
+	select {
+	case <-home.readyDone:
+		return true
+	default:
+	}
+	_, span := StartSpan(ctx, "wait_ready", SpanKindInternal, "user", home.User)
+	defer span.Finish()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-home.readyDone:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	span.SetError("devices not discovered in time")
+	return false
+}
+
+// Connect to the broker of one home and wait until its devices are discovered.
+func (home *Home) ConnectMQTT(slug string) {
+	readyTopic := "tmp/" + slug + "/READY"
+	onConnect := func() {
+		// the session is clean, subscriptions don't survive losing the connection
+		home.deviceLock.Lock()
+		resubscribe := home.resubscribe
+		if resubscribe {
+			home.subscribed = false
+		}
+		home.deviceLock.Unlock()
+		if resubscribe {
+			go home.subscribe(readyTopic)
+		}
+	}
+
+	client, err := ConnectToMQTT(home.Broker, slug, home.User, onConnect)
+	for ; err != nil; client, err = ConnectToMQTT(home.Broker, slug, home.User, onConnect) {
+		time.Sleep(1 * time.Second)
+	}
+	// handlers run while we connect, and only use the client once devices appear
+	home.clientLock.Lock()
+	home.client = client
+	home.clientLock.Unlock()
+
+	home.subscribe(readyTopic)
+	home.deviceLock.Lock()
+	home.resubscribe = true
+	home.deviceLock.Unlock()
 
 	// Send a sentinal to infer whether we've received all retained discovery messages.
 	retained := false
@@ -390,8 +676,12 @@ func MQTT() {
 	if token.Error() != nil {
 		log.Panicf("Publish READY failed: %q\n", token.Error())
 	}
-	<-readyCh
-	log.Printf("Discovered %d MQTT devices\n", len(devices))
+	<-home.readyCh
+	home.deviceLock.Lock()
+	home.discovered = true
+	close(home.readyDone)
+	log.Printf("Discovered %d MQTT devices for %q\n", len(home.devices), home.User)
+	home.deviceLock.Unlock()
 
 	// Send another sentinal to infer whether we've received all state queries
 	retained = false
@@ -400,7 +690,40 @@ func MQTT() {
 	if token.Error() != nil {
 		log.Panicf("Publish READY failed: %q\n", token.Error())
 	}
-	<-readyCh
+	<-home.readyCh
+}
+
+func MQTT() {
+	mqtt.ERROR = NewStdLogger(SeverityError, "mqtt")
+	mqtt.CRITICAL = NewStdLogger(SeverityError, "mqtt")
+	mqtt.WARN = NewStdLogger(SeverityWarning, "mqtt")
+	//mqtt.DEBUG = NewStdLogger(SeverityDebug, "mqtt") // quite verbose
+
+	// Each home has its own broker, connect to all of them in parallel.
+	var wg sync.WaitGroup
+	for _, home := range homes {
+		wg.Add(1)
+		go func(home *Home) {
+			defer wg.Done()
+			// Only one client with the same ID can connect, so the slug has
+			// to differ between instances and between homes.
+			home.ConnectMQTT(HashString(settings.InstanceId + "/" + home.User))
+		}(home)
+	}
+	wg.Wait()
 
 	log.Println("Completed MQTT Initialization")
 }
+
+// Disconnect from the brokers of all homes, giving the client a moment to finish
+// sending what it has queued.
+func DisconnectMQTT() {
+	for _, home := range homes {
+		client := home.mqttClient()
+		if client != nil && client.IsConnected() {
+			client.Disconnect(250)
+			metricMQTTConnected.Set(0, home.User)
+			log.Printf("Disconnected MQTT for %q\n", home.User)
+		}
+	}
+}
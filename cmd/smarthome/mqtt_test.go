@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A token which has completed successfully.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                       { return true }
+func (doneToken) WaitTimeout(d time.Duration) bool { return true }
+func (doneToken) Error() error                     { return nil }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// An MQTT client recording what is published. If reply is set it is called
+// with each message in a goroutine of its own, like a device answering.
+type fakeClient struct {
+	mqtt.Client
+	reply func(topic, payload string)
+
+	mu        sync.Mutex
+	published []string
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	c.published = append(c.published, fmt.Sprintf("%s %v", topic, payload))
+	c.mu.Unlock()
+	if c.reply != nil {
+		go c.reply(topic, fmt.Sprint(payload))
+	}
+	return doneToken{}
+}
+
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+
+func (c *fakeClient) Published() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.published...)
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+// Deliver a message to the home as if it came from its broker.
+func (home *Home) deliver(topic, payload string) {
+	home.mqttMessageHandler(home.mqttClient(), fakeMessage{topic: topic, payload: payload})
+}
+
+// A home with a fake client and a relay for each topic, keyed by the topic like
+// stat/+/RESULT messages are looked up.
+func newTestHome(topics ...string) (*Home, *fakeClient) {
+	home := NewHome()
+	home.User = "test"
+	client := &fakeClient{}
+	home.client = client
+	for _, topic := range topics {
+		d := NewDevice(home)
+		d.MacAddress = topic
+		d.TopicName = topic
+		d.FriendlyName = topic
+		d.HasRelays = true
+		d.HasOnOff = true
+		d.PowerState = "OFF"
+		home.devices[topic] = d
+	}
+	home.discovered = true
+	close(home.readyDone)
+	return home, client
+}
+
+// A message from a device, on stat/+/RESULT if isResult, else on tele/+/STATE.
+type testMessage struct {
+	payload  string
+	isResult bool
+}
+
+var (
+	// periodic telemetry, even with the state asked for, is no reply
+	teleOn = testMessage{`{"Time":"2021-03-28T14:46:16","POWER":"ON","Wifi":{"RSSI":44,"Signal":-78}}`, false}
+	// someone pressing the button
+	pressedOff = testMessage{`{"POWER":"OFF"}`, true}
+	// a reply to some other command
+	dimmer    = testMessage{`{"Dimmer":50}`, true}
+	resultOn  = testMessage{`{"POWER":"ON"}`, true}
+	errorOn   = testMessage{`{"Command":"Error"}`, true}
+	unknownOn = testMessage{`{"Command":"Unknown"}`, true}
+	// an error has to be a reply to a command
+	teleError = testMessage{`{"Command":"Error"}`, false}
+)
+
+func TestParseTasmotaResultInterleaved(t *testing.T) {
+	tests := []struct {
+		name      string
+		expect    string
+		messages  []testMessage
+		wantFires int // the message which notifies, -1 for none
+		wantState string
+		wantError string
+	}{
+		{"reply after telemetry", "ON", []testMessage{teleOn, pressedOff, dimmer, resultOn}, 3, "ON", ""},
+		{"reply first", "ON", []testMessage{resultOn, teleOn}, 0, "ON", ""},
+		{"only telemetry", "ON", []testMessage{teleOn, teleOn}, -1, "", ""},
+		{"button pressed", "ON", []testMessage{pressedOff}, -1, "", ""},
+		{"rejected", "ON", []testMessage{teleOn, errorOn}, 1, "ON", "Error"},
+		{"unknown command", "OFF", []testMessage{unknownOn}, 0, "OFF", "Unknown"},
+		{"error in telemetry", "ON", []testMessage{teleError}, -1, "", ""},
+		// a QUERY takes whatever state comes first
+		{"query", "", []testMessage{teleOn}, 0, "ON", ""},
+		{"query answered by the button", "", []testMessage{pressedOff, teleOn}, 0, "OFF", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDevice(NewHome())
+			d.MacAddress = "relay"
+			d.PowerState = "OFF"
+			ch := make(chan NotifyState, 1)
+			d.OneshotNotify["r1"] = OneshotRequest{Ch: ch, Expect: tt.expect}
+			// an error only answers the command last sent to the device
+			d.home.sentCommand(d.TopicName, "POWER")
+
+			fired := -1
+			var update NotifyState
+			for i, m := range tt.messages {
+				if err := parseTasmotaResult(&d, []byte(m.payload), m.isResult); err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				select {
+				case u := <-ch:
+					if fired >= 0 {
+						t.Fatalf("message %d notified again", i)
+					}
+					fired, update = i, u
+				default:
+				}
+			}
+			if fired != tt.wantFires {
+				t.Fatalf("message %d notified, want %d", fired, tt.wantFires)
+			}
+			if fired < 0 {
+				if len(d.OneshotNotify) != 1 {
+					t.Errorf("listener removed without being notified")
+				}
+				return
+			}
+			if update.Id != "relay" || update.PowerState != tt.wantState || update.Error != tt.wantError {
+				t.Errorf("update = %+v, want %s %q", update, tt.wantState, tt.wantError)
+			}
+			if len(d.OneshotNotify) != 0 {
+				t.Errorf("listener not removed: %v", d.OneshotNotify)
+			}
+		})
+	}
+}
+
+func TestParseTasmotaWifi(t *testing.T) {
+	d := NewDevice(NewHome())
+	if err := parseTasmotaResult(&d, []byte(teleOn.payload), teleOn.isResult); err != nil {
+		t.Fatal(err)
+	}
+	if d.RSSI != 44 || d.Signal != -78 {
+		t.Errorf("Wifi = %d%% %d dBm, want 44%% -78 dBm", d.RSSI, d.Signal)
+	}
+}
+
+func TestParseTasmotaResultError(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		sent     string
+		payload  string
+		isResult bool
+		want     string // the Error notified, "-" for none
+	}{
+		{"power rejected", "", "POWER", `{"Command":"Error"}`, true, "Error"},
+		{"lower case topic", "", "power", `{"Command":"Unknown"}`, true, "Unknown"},
+		{"fan speed rejected", "FanSpeed", "FanSpeed", `{"Command":"Error"}`, true, "Error"},
+		{"another command rejected", "", "Dimmer", `{"Command":"Error"}`, true, "-"},
+		{"another command after ours", "FanSpeed", "Status", `{"Command":"Unknown"}`, true, "-"},
+		{"not on stat RESULT", "", "POWER", `{"Command":"Error"}`, false, "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, _ := newTestHome("relay")
+			d := home.devices["relay"]
+			ch := make(chan NotifyState, 1)
+			d.OneshotNotify["r1/relay"] = OneshotRequest{Ch: ch, Id: "relay", Key: tt.key, Expect: "1", RequestId: "r1"}
+			home.sentCommand("relay", tt.sent)
+
+			if err := parseTasmotaResult(&d, []byte(tt.payload), tt.isResult); err != nil {
+				t.Fatal(err)
+			}
+			got := "-"
+			select {
+			case update := <-ch:
+				got = update.Error
+			default:
+			}
+			if got != tt.want {
+				t.Errorf("error notified = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTasmotaDiscovery(t *testing.T) {
+	payload := `{"ip":"10.1.10.100","dn":"Tasmota","fn":["ParentsRoomSwitch",null],
+		"hn":"parents-room-switch","mac":"BCDDC2000000","md":"MJ-S01 Switch","sw":"9.3.1",
+		"t":"parents-room-switch","rl":[1,0,0,0],"state":["OFF","ON","TOGGLE","HOLD"]}`
+	var d TasmotaDevice
+	if err := parseTasmotaDiscovery(&d, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if d.MacAddress != "BCDDC2000000" || d.TopicName != "parents-room-switch" ||
+		d.FriendlyName != "ParentsRoomSwitch" || !d.HasRelays || !d.HasOnOff || d.IsFan {
+		t.Errorf("device = %+v", d)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/server"
+)
+
+// Check the client_id and client_secret of a /revoke or /introspect request,
+// from either HTTP Basic authentication or the form, returning the client id.
+func authenticateClient(ctx context.Context, clients oauth2.ClientStore, r *http.Request) (string, bool) {
+	id, secret, err := server.ClientBasicHandler(r)
+	if err != nil {
+		id, secret, err = server.ClientFormHandler(r)
+	}
+	if err != nil {
+		return "", false
+	}
+	cli, err := clients.GetByID(ctx, id)
+	if err != nil || cli == nil {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(cli.GetSecret()), []byte(secret)) != 1 {
+		return "", false
+	}
+	return id, true
+}
+
+func revokeAccessToken(ctx context.Context, manager *manage.Manager, access string, expires time.Time) error {
+	if err := revocations.RevokeToken(TokenHash(access), expires); err != nil {
+		return err
+	}
+	manager.RemoveAccessToken(ctx, access)
+	return nil
+}
+
+// Token revocation https://tools.ietf.org/html/rfc7009
+// Revoking a refresh token also revokes the access token issued along with it.
+// Tokens which are unknown, expired or belong to another client are ignored,
+// the response is the same as for a successful revocation.
+func HandleRevoke(manager *manage.Manager, clients oauth2.ClientStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		clientId, ok := authenticateClient(ctx, clients, r)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if claims, ok := parseAccessToken(token); ok {
+			if claims.Audience == clientId {
+				err := revokeAccessToken(ctx, manager, token, time.Unix(claims.ExpiresAt, 0))
+				if err != nil {
+					log.Printf("Revoking access token failed: %v\n", err)
+					http.Error(w, "Revocation failed", http.StatusServiceUnavailable)
+					return
+				}
+				log.Printf("Revoked access token of %q\n", claims.Subject)
+			}
+		} else if ti, err := manager.LoadRefreshToken(ctx, token); err == nil && ti.GetClientID() == clientId {
+			expires := ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn())
+			err = revokeAccessToken(ctx, manager, ti.GetAccess(), expires)
+			if err != nil {
+				log.Printf("Revoking access token failed: %v\n", err)
+				http.Error(w, "Revocation failed", http.StatusServiceUnavailable)
+				return
+			}
+			manager.RemoveRefreshToken(ctx, token)
+			log.Printf("Revoked refresh token of %q\n", ti.GetUserID())
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Token introspection https://tools.ietf.org/html/rfc7662
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+}
+
+func introspect(ctx context.Context, manager *manage.Manager, token string) IntrospectionResponse {
+	if claims, ok := parseAccessToken(token); ok {
+		issuedAt := claims.IssuedAtTime()
+		if IsRevoked(token, claims.Subject, issuedAt) {
+			return IntrospectionResponse{}
+		}
+		return IntrospectionResponse{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientId:  claims.Audience,
+			Username:  claims.Subject,
+			TokenType: "access_token",
+			Exp:       claims.ExpiresAt,
+			Iat:       issuedAt.Unix(),
+			Sub:       claims.Subject,
+			Aud:       claims.Audience,
+		}
+	}
+
+	ti, err := manager.LoadRefreshToken(ctx, token)
+	if err != nil || IsRevoked(token, ti.GetUserID(), ti.GetRefreshCreateAt()) {
+		return IntrospectionResponse{}
+	}
+	resp := IntrospectionResponse{
+		Active:    true,
+		Scope:     ti.GetScope(),
+		ClientId:  ti.GetClientID(),
+		Username:  ti.GetUserID(),
+		TokenType: "refresh_token",
+		Iat:       ti.GetRefreshCreateAt().Unix(),
+		Sub:       ti.GetUserID(),
+		Aud:       ti.GetClientID(),
+	}
+	if ti.GetRefreshExpiresIn() > 0 {
+		resp.Exp = ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn()).Unix()
+	}
+	return resp
+}
+
+func HandleIntrospect(manager *manage.Manager, clients oauth2.ClientStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		if _, ok := authenticateClient(ctx, clients, r); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+
+		resp := introspect(ctx, manager, r.PostFormValue("token"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Refuse to refresh tokens of a user whose tokens were all revoked, as the
+// token store can't list the refresh tokens of a user to remove them.
+func RefreshAllowed(ctx context.Context, manager *manage.Manager, r *http.Request) bool {
+	if r.FormValue("grant_type") != "refresh_token" {
+		return true
+	}
+	refresh := r.FormValue("refresh_token")
+	ti, err := manager.LoadRefreshToken(ctx, refresh)
+	if err != nil {
+		// the token endpoint will reject it anyway
+		return true
+	}
+	return !IsRevoked(refresh, ti.GetUserID(), ti.GetRefreshCreateAt())
+}
+
+// Admin action revoking every token ever issued to a user, who will have to
+// link their account again. POST /admin/revoke-user with user=name.
+func HandleRevokeUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	user := strings.TrimSpace(r.PostFormValue("user"))
+	if user == "" {
+		http.Error(w, "user required", http.StatusBadRequest)
+		return
+	}
+
+	err := revocations.RevokeUser(user, time.Now())
+	if err != nil {
+		log.Printf("Revoking user %q failed: %v\n", user, err)
+		http.Error(w, "Revocation failed", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Revoked all tokens of %q\n", user)
+	w.WriteHeader(http.StatusOK)
+}
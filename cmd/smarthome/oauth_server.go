@@ -1,60 +1,82 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-oauth2/oauth2/v4/errors"
-	"github.com/go-oauth2/oauth2/v4/generates"
 	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/models"
 	"github.com/go-oauth2/oauth2/v4/server"
 	"github.com/go-oauth2/oauth2/v4/store"
 )
 
-func ValidateJWT(r *http.Request) (bool, string) {
+// Our interactions with users are in the form of smart home commands like
+// turning lights on. We'd like to minimize the latency from the time when the
+// user says "turn the light on" until the light turns on, so let the Access
+// Token live a long time to not spend round trips to refresh it.
+// Note that Google's server-side code discards this token well before the long
+// expiration time we give here. We just don't want to be the limit.
+const (
+	accessTokenExp  = time.Hour * 24 * 7
+	refreshTokenExp = time.Hour * 24 * 7
+)
+
+// The OAuth client our access tokens have to be issued to, Google Smart Home.
+var oauthClientId string
+
+// Check the access token of a request, returning its claims or a reason it
+// was rejected. The Subject of the claims is the user the token was issued to.
+func ValidateJWT(r *http.Request) (*AccessClaims, string) {
 	reqToken := r.Header.Get("Authorization")
 	if reqToken == "" {
-		return false, "No Authorization header"
+		return nil, "No Authorization header"
 	}
-	splitToken := strings.Split(reqToken, " ")
-	access := splitToken[1]
-
-	token, err := jwt.ParseWithClaims(access, &generates.JWTAccessClaims{},
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Parse JWT error")
-			}
-			return []byte(os.Getenv("OAUTH_JWT_KEY")), nil
-		})
-	if err != nil {
-		return false, "Unauthorized"
+	splitToken := strings.SplitN(reqToken, " ", 2)
+	if len(splitToken) != 2 || !strings.EqualFold(splitToken[0], "Bearer") {
+		return nil, "Authorization header is not a Bearer token"
+	}
+	access := strings.TrimSpace(splitToken[1])
+	if access == "" {
+		return nil, "Empty Bearer token"
+	}
+
+	// checks the signature, exp and nbf
+	claims, ok := parseAccessToken(access)
+	if !ok {
+		return nil, "Unauthorized"
+	}
+
+	if oauthClientId == "" || !claims.VerifyAudience(oauthClientId, true) {
+		return nil, "Token issued to another client"
+	}
+	if !claims.AllowsFulfillment() {
+		return nil, "Token lacks scope " + fulfillmentScope
 	}
 
-	_, ok := token.Claims.(*generates.JWTAccessClaims)
-	if !ok || !token.Valid {
-		return false, "Invalid token"
+	if IsRevoked(access, claims.Subject, claims.IssuedAtTime()) {
+		return nil, "Token revoked"
 	}
 
-	return true, ""
+	return claims, ""
 }
 
 func SetupOauth(mux *http.ServeMux) {
 	manager := manage.NewDefaultManager()
-	manager.MustTokenStorage(store.NewMemoryTokenStore())
+
+	// Refresh tokens and authorization codes have to outlive this instance, the
+	// code is issued by /authorize and may be redeemed at /token on another one.
+	manager.MustTokenStorage(OpenTokenStore(settings.TokenStore))
 
 	// We only have one OAuth client to populate, used by Google Smart Home
 	// for https://developers.google.com/assistant/smarthome/overview
 	clientStore := store.NewClientStore()
-	clientId := os.Getenv("OAUTH_CLIENT")
-	clientStore.Set(clientId, &models.Client{
-		ID:     clientId,
-		Secret: os.Getenv("OAUTH_SECRET"),
+	oauthClientId = settings.OAuthClient
+	clientStore.Set(oauthClientId, &models.Client{
+		ID:     oauthClientId,
+		Secret: settings.OAuthSecret,
 		Domain: "https://oauth-redirect.googleusercontent.com/",
 	})
 	manager.MapClientStorage(clientStore)
@@ -62,23 +84,27 @@ func SetupOauth(mux *http.ServeMux) {
 	// Running in Cloud Run, we'd like to allow Smart Home to authenticate once and
 	// get a token from one of our instances, and be able to use that token with any
 	// running instance. We'd have to run a central DB somewhere to store sessions,
-	// Firebase maybe, but instead we use JWT to make out tokens using a secret
+	// Firebase maybe, but instead we use JWT to make out tokens using a key
 	// which Cloud Run passes in from the environment. https://jwt.io/
 	// Any of our instances can validate the token created by any other instance.
-	jwt_key := []byte(os.Getenv("OAUTH_JWT_KEY"))
-	manager.MapAccessGenerate(generates.NewJWTAccessGenerate("", jwt_key,
-		jwt.SigningMethodHS512))
-
-	// Our interactions with users are in the form of smart home commands like
-	// turning lights on. We'd like to minimize the latency from the time when the
-	// user says "turn the light on" until the light turns on, so let the Access
-	// Token live a long time to not spend round trips to refresh it.
-	// Note that Google's server-side code discards this token well before the long
-	// expiration time we give here. We just don't want to be the limit.
+	var err error
+	jwtKeys, err = LoadJWTKeys()
+	if err != nil {
+		log.Fatalf("Loading JWT keys failed: %v", err)
+	}
+	manager.MapAccessGenerate(NewAccessGenerate(jwtKeys))
+
+	// Revoked tokens have to be refused by every instance, like the token store
+	// the revocation list should be shared between them.
+	revocations, err = OpenRevocationList(settings.RevocationStore)
+	if err != nil {
+		log.Fatalf("Opening revocation list failed: %v", err)
+	}
+
 	manager.SetAuthorizeCodeExp(time.Minute * 10)
 	cfg := &manage.Config{
-		AccessTokenExp:    time.Hour * 24 * 7,
-		RefreshTokenExp:   time.Hour * 24 * 7,
+		AccessTokenExp:    accessTokenExp,
+		RefreshTokenExp:   refreshTokenExp,
 		IsGenerateRefresh: true,
 	}
 	manager.SetAuthorizeCodeTokenCfg(cfg)
@@ -97,21 +123,40 @@ func SetupOauth(mux *http.ServeMux) {
 			re.Error.Error(), re.Description, re.URI)
 	})
 
-	// We don't want to spin up a shared session database like Firebase, and we only
-	// have one OAuth client which only has one user. Return that user, always.
-	srv.SetUserAuthorizationHandler(
-		func(w http.ResponseWriter, r *http.Request) (userID string, err error) {
-			return "google_smart_home", nil
-		})
+	// We only have one OAuth client, but each home has its own user configured
+	// locally. They have to log in and consent before Google gets an authorization
+	// code, and the user becomes the subject of the tokens issued for that code.
+	srv.SetUserAuthorizationHandler(HandleUserAuthorization)
 
 	// instantiate handlers on our HTTP server
 	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if !validScope(r.FormValue("scope")) {
+			log.Printf("Refusing /authorize for scope %q\n", r.FormValue("scope"))
+			http.Error(w, "invalid_scope: only "+fulfillmentScope+" can be granted", http.StatusBadRequest)
+			return
+		}
 		err := srv.HandleAuthorizeRequest(w, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
 	})
 	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if !validScope(r.FormValue("scope")) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_scope"}`))
+			return
+		}
+		if !RefreshAllowed(r.Context(), manager, r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
 		srv.HandleTokenRequest(w, r)
 	})
+	mux.HandleFunc("/revoke", HandleRevoke(manager, clientStore))
+	mux.HandleFunc("/introspect", HandleIntrospect(manager, clientStore))
+	mux.HandleFunc("/admin/revoke-user", RequireAdmin(HandleRevokeUser))
+	mux.HandleFunc("/.well-known/jwks.json", jwtKeys.HandleJWKS)
 }
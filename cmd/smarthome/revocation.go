@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Access tokens are JWTs which any instance can check without a database, so
+// revoking one means remembering that it was revoked until it expires. We also
+// remember when all tokens of a user were revoked, tokens issued before then
+// are refused. ValidateJWT consults this on every /fulfillment request.
+type RevocationList interface {
+	RevokeToken(hash string, expires time.Time) error
+	IsTokenRevoked(hash string) (bool, error)
+	RevokeUser(user string, at time.Time) error
+	// The zero Time if the user was never revoked.
+	UserRevokedAt(user string) (time.Time, error)
+}
+
+var revocations RevocationList
+
+// Identifies a token in the revocation list without storing the token itself.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// A RevocationList in a buntdb database, either in memory or in a file.
+type buntRevocationList struct {
+	db *buntdb.DB
+}
+
+// Open the revocation list described by spec, "memory:" or "file:path" like
+// OAUTH_TOKEN_STORE. As with the token store, revocations kept in memory only
+// apply to this instance and are forgotten when it restarts.
+func OpenRevocationList(spec string) (RevocationList, error) {
+	if spec == "" {
+		spec = "memory:"
+	}
+	var path string
+	switch {
+	case spec == "memory:":
+		path = ":memory:"
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		path = spec[len("file:"):]
+	default:
+		return nil, fmt.Errorf("unknown OAuth revocation store %q", spec)
+	}
+
+	db, err := buntdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &buntRevocationList{db: db}, nil
+}
+
+func (l *buntRevocationList) RevokeToken(hash string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+	return l.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("token:"+hash, "", &buntdb.SetOptions{Expires: true, TTL: ttl})
+		return err
+	})
+}
+
+func (l *buntRevocationList) IsTokenRevoked(hash string) (bool, error) {
+	err := l.db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get("token:" + hash)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *buntRevocationList) RevokeUser(user string, at time.Time) error {
+	// Once the longest lived token issued before now has expired, there is
+	// nothing left to refuse.
+	ttl := time.Until(at.Add(refreshTokenExp))
+	return l.db.Update(func(tx *buntdb.Tx) error {
+		value := strconv.FormatInt(at.Unix(), 10)
+		_, _, err := tx.Set("user:"+user, value, &buntdb.SetOptions{Expires: true, TTL: ttl})
+		return err
+	})
+}
+
+func (l *buntRevocationList) UserRevokedAt(user string) (time.Time, error) {
+	var value string
+	err := l.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		value, err = tx.Get("user:" + user)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	at, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(at, 0), nil
+}
+
+// Whether a token issued to user at issuedAt has been revoked, either by itself
+// or along with all other tokens of the user. Errors count as revoked. Times are
+// in whole seconds like the iat of a JWT, so a token issued in the second the
+// user was revoked is accepted: the user linking their account again right
+// after revoking must not be refused.
+func IsRevoked(token, user string, issuedAt time.Time) bool {
+	revoked, err := revocations.IsTokenRevoked(TokenHash(token))
+	if err != nil {
+		log.Printf("Revocation list lookup failed: %v\n", err)
+		return true
+	}
+	if revoked {
+		return true
+	}
+
+	at, err := revocations.UserRevokedAt(user)
+	if err != nil {
+		log.Printf("Revocation list lookup failed: %v\n", err)
+		return true
+	}
+	return !at.IsZero() && issuedAt.Before(at)
+}
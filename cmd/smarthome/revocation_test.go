@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsRevoked(t *testing.T) {
+	list, err := OpenRevocationList("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations = list
+	now := time.Now().Truncate(time.Second)
+	if err := revocations.RevokeToken(TokenHash("stolen"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := revocations.RevokeUser("alice", now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		user     string
+		issuedAt time.Time
+		want     bool
+	}{
+		{"revoked token", "stolen", "bob", now, true},
+		{"other token", "fine", "bob", now.Add(-time.Hour), false},
+		{"issued before the user was revoked", "old", "alice", now.Add(-time.Second), true},
+		{"issued in the same second", "relinked", "alice", now, false},
+		{"issued after", "new", "alice", now.Add(time.Second), false},
+	}
+	for _, tt := range tests {
+		if got := IsRevoked(tt.token, tt.user, tt.issuedAt); got != tt.want {
+			t.Errorf("%s: IsRevoked = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
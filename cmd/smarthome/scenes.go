@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// One Tasmota command sent when a scene is activated, published to
+// cmnd/<topic of Device>/<Command>. For example {"device":"BCDDC2000000",
+// "command":"Dimmer","payload":"30"} or {"device":"BCDDC2000001",
+// "command":"Color","payload":"FF8000"}.
+type SceneCommand struct {
+	Device  string `json:"device"`
+	Command string `json:"command"`
+	Payload string `json:"payload"`
+}
+
+// A scene like "movie night", keyed by its device id in Home.Scenes. Google can
+// only turn it off again if there are Deactivate commands.
+type SceneConfig struct {
+	Name       string         `json:"name"`
+	Activate   []SceneCommand `json:"activate"`
+	Deactivate []SceneCommand `json:"deactivate,omitempty"`
+}
+
+func (home *Home) checkScenes() error {
+	for id, scene := range home.Scenes {
+		// the device ids are MAC addresses, and fan lights end in lightIdSuffix
+		if _, ok := home.Devices[id]; ok || strings.HasSuffix(id, lightIdSuffix) {
+			return fmt.Errorf("scene %s of %q has the id of a device", id, home.User)
+		}
+		if scene.Name == "" {
+			return fmt.Errorf("scene %s of %q has no name", id, home.User)
+		}
+		if len(scene.Activate) == 0 {
+			return fmt.Errorf("scene %s of %q has no commands", id, home.User)
+		}
+		for _, c := range append(scene.Activate, scene.Deactivate...) {
+			if c.Device == "" || c.Command == "" || strings.ContainsAny(c.Command, "/+#") {
+				return fmt.Errorf("scene %s of %q: bad command %+v", id, home.User, c)
+			}
+			if home.Devices[c.Device].Challenge != "" {
+				return fmt.Errorf("scene %s of %q would bypass the challenge of device %s", id, home.User, c.Device)
+			}
+		}
+	}
+	return nil
+}
+
+// The id of a scene sending commands to the device, if any.
+func (home *Home) sceneCommanding(device string) string {
+	for id, scene := range home.Scenes {
+		for _, c := range append(scene.Activate, scene.Deactivate...) {
+			if c.Device == device {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// Produce the Device portion of a SYNC response for a scene.
+// https://developers.google.com/assistant/smarthome/traits/scene
+func (scene *SceneConfig) ToIntentSyncResponseDevice(id string) IntentSyncResponseDevice {
+	var sync IntentSyncResponseDevice
+	sync.Id = id
+	sync.Type = "action.devices.types.SCENE"
+	sync.Traits = []string{"action.devices.traits.Scene"}
+	sync.Name.Name = scene.Name
+	sync.WillReportState = false
+	sync.Attributes = &IntentSyncResponseAttributes{
+		SceneReversible: len(scene.Deactivate) > 0,
+	}
+	return sync
+}
+
+// Send the commands of a scene to its devices, in the order configured. Tasmota
+// doesn't report anything useful for most of them, so we don't wait for replies.
+func (home *Home) activateScene(ctx context.Context, id string, deactivate bool) IntentErrorCode {
+	scene := home.Scenes[id]
+	commands := scene.Activate
+	if deactivate {
+		if len(scene.Deactivate) == 0 {
+			return ErrorFunctionNotSupported
+		}
+		commands = scene.Deactivate
+	}
+
+	// look up all topics first, a scene half carried out is worse than none
+	topics := make([]string, len(commands))
+	home.deviceLock.Lock()
+	for i, c := range commands {
+		d, ok := home.devices[c.Device]
+		if !ok {
+			home.deviceLock.Unlock()
+			log.Printf("Scene %s: device %s not discovered\n", id, c.Device)
+			return ErrorDeviceOffline
+		}
+		topics[i] = d.TopicName
+	}
+	home.deviceLock.Unlock()
+
+	for i, c := range commands {
+		err := home.SendCommand(ctx, topics[i], c.Command, c.Payload)
+		if err != nil {
+			log.Printf("Scene %s: %v\n", id, err)
+			return ErrorTransientError
+		}
+	}
+	return ""
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testScenes() map[string]SceneConfig {
+	return map[string]SceneConfig{
+		"movie-night": {
+			Name: "Movie night",
+			Activate: []SceneCommand{
+				{Device: "lamp", Command: "Dimmer", Payload: "30"},
+				{Device: "tv", Command: "Power", Payload: "ON"},
+			},
+			Deactivate: []SceneCommand{{Device: "lamp", Command: "Dimmer", Payload: "100"}},
+		},
+		"away": {
+			Name:     "Away",
+			Activate: []SceneCommand{{Device: "lamp", Command: "Power", Payload: "OFF"}},
+		},
+		"garden": {
+			Name:     "Garden",
+			Activate: []SceneCommand{{Device: "pump", Command: "Power", Payload: "ON"}},
+		},
+	}
+}
+
+func TestActivateScene(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		execution     string
+		wantResponse  string
+		wantPublished []string
+	}{
+		{"activate", "movie-night", `{"command":"action.devices.commands.ActivateScene","params":{}}`,
+			"movie-night SUCCESS on=false", []string{"cmnd/lamp/Dimmer 30", "cmnd/tv/Power ON"}},
+		{"deactivate", "movie-night", `{"command":"action.devices.commands.ActivateScene","params":{"deactivate":true}}`,
+			"movie-night SUCCESS on=false", []string{"cmnd/lamp/Dimmer 100"}},
+		{"not reversible", "away", `{"command":"action.devices.commands.ActivateScene","params":{"deactivate":true}}`,
+			"away ERROR functionNotSupported", nil},
+		{"other command", "away", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			"away ERROR functionNotSupported", nil},
+		// nothing is sent if one of the devices isn't there
+		{"device missing", "garden", `{"command":"action.devices.commands.ActivateScene","params":{}}`,
+			"garden OFFLINE deviceOffline", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("lamp", "tv")
+			home.Scenes = testScenes()
+			data, err := home.GenerateExecuteResponse(context.Background(), executeRequest(tt.id, tt.execution))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := summarizeExecute(decodeExecuteResponse(t, data))
+			if len(got) != 1 || got[0] != tt.wantResponse {
+				t.Errorf("response %v, want %q", got, tt.wantResponse)
+			}
+			published := client.Published()
+			if strings.Join(published, ",") != strings.Join(tt.wantPublished, ",") {
+				t.Errorf("published %v, want %v", published, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestSceneSyncAndQuery(t *testing.T) {
+	settings = &Config{}
+	home, _ := newTestHome("lamp", "tv")
+	home.Scenes = testScenes()
+
+	data, err := home.GenerateSyncResponse(context.Background(), IntentSyncRequest{RequestId: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sync IntentSyncResponse
+	if err := json.Unmarshal(data, &sync); err != nil {
+		t.Fatal(err)
+	}
+	scenes := make(map[string]IntentSyncResponseDevice)
+	for _, d := range sync.Payload.Devices {
+		if d.Type == "action.devices.types.SCENE" {
+			scenes[d.Id] = d
+		}
+	}
+	if len(scenes) != 3 {
+		t.Fatalf("scenes in SYNC: %v", scenes)
+	}
+	if d := scenes["movie-night"]; d.Name.Name != "Movie night" || !d.Attributes.SceneReversible {
+		t.Errorf("movie-night = %+v", d)
+	}
+	if d := scenes["away"]; d.Attributes.SceneReversible {
+		t.Errorf("away is reversible")
+	}
+
+	var query IntentQueryRequest
+	if err := json.Unmarshal([]byte(`{"requestId":"r2","inputs":[{"intent":"action.devices.QUERY",
+		"payload":{"devices":[{"id":"away"}]}}]}`), &query); err != nil {
+		t.Fatal(err)
+	}
+	data, err = home.GenerateQueryResponse(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Payload.Devices) != 1 || !resp.Payload.Devices[0].Online ||
+		resp.Payload.Devices[0].Status != StatusSuccess {
+		t.Errorf("QUERY of a scene: %+v", resp.Payload.Devices)
+	}
+}
+
+func TestCheckScenes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scene   SceneConfig
+		wantErr string
+	}{
+		{"valid", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "lamp", Command: "Power", Payload: "ON"}}}, ""},
+		{"no name", SceneConfig{Activate: []SceneCommand{{Device: "lamp", Command: "Power"}}}, "has no name"},
+		{"no commands", SceneConfig{Name: "A"}, "has no commands"},
+		{"no device", SceneConfig{Name: "A", Activate: []SceneCommand{{Command: "Power"}}}, "bad command"},
+		{"wildcard", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "lamp", Command: "#"}}}, "bad command"},
+		{"bad deactivate", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "lamp", Command: "Power"}},
+			Deactivate: []SceneCommand{{Device: "lamp", Command: "a/b"}}}, "bad command"},
+		{"pin needed", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "door", Command: "Power", Payload: "ON"}}},
+			"bypass the challenge of device door"},
+		{"ack needed", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "heater", Command: "Power", Payload: "ON"}}},
+			"bypass the challenge of device heater"},
+		{"deactivate pin needed", SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "lamp", Command: "Power"}},
+			Deactivate: []SceneCommand{{Device: "door", Command: "Power"}}}, "bypass the challenge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := NewHome()
+			home.User = "test"
+			home.Devices = testChallengeDevices()
+			home.Scenes = map[string]SceneConfig{"scene": tt.scene}
+			err := home.checkScenes()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("checkScenes: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkScenes: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func testChallengeDevices() map[string]DeviceConfig {
+	return map[string]DeviceConfig{
+		"lamp":   {Name: "Lamp"},
+		"door":   {Type: "lock", Challenge: "pinNeeded", Pin: "1234"},
+		"heater": {Challenge: "ackNeeded"},
+	}
+}
+
+func TestSceneIdCollision(t *testing.T) {
+	scene := SceneConfig{Name: "A", Activate: []SceneCommand{{Device: "lamp", Command: "Power", Payload: "ON"}}}
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"evening", false},
+		{"lamp", true},
+		{"door", true},
+		{"fan" + lightIdSuffix, true},
+	}
+	for _, tt := range tests {
+		home := NewHome()
+		home.User = "test"
+		home.Devices = testChallengeDevices()
+		home.Scenes = map[string]SceneConfig{tt.id: scene}
+		if err := home.checkScenes(); (err != nil) != tt.wantErr {
+			t.Errorf("scene %s: checkScenes = %v, want error %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+// The API must not add a challenge a scene would bypass, or a device shadowed by
+// a scene.
+func TestSetDeviceConfigScenes(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		config  DeviceConfig
+		wantErr string
+	}{
+		{"rename", "lamp", DeviceConfig{Name: "Reading lamp"}, ""},
+		{"ack needed", "lamp", DeviceConfig{Challenge: "ackNeeded"}, "sends it commands"},
+		{"lock", "tv", DeviceConfig{Type: "lock", Challenge: "pinNeeded", Pin: "1234"}, "scene movie-night sends it commands"},
+		{"not in a scene", "door", DeviceConfig{Challenge: "pinNeeded", Pin: "1234"}, ""},
+		{"scene id", "away", DeviceConfig{Name: "Away"}, "has the id of a scene"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := NewHome()
+			home.User = "test"
+			home.Scenes = testScenes()
+			_, err := home.setDeviceConfig(tt.id, tt.config)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("setDeviceConfig: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("setDeviceConfig: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Cloud Run sends SIGTERM and allows 10 seconds before SIGKILL. Requests in
+// flight, like an EXECUTE which already published its command, get most of that
+// to be answered.
+const shutdownTimeout = 8 * time.Second
+
+var (
+	shutdownOnce sync.Once
+	draining     int32 // set once shutting down, see isDraining
+)
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// Shut down gracefully on SIGTERM or SIGINT.
+func HandleSignals(srv *http.Server, done chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		log.Printf("Received %v\n", sig)
+		beginShutdown(srv, done)
+	}()
+}
+
+// Start shutting down, unless already doing so. done is closed when finished.
+func beginShutdown(srv *http.Server, done chan struct{}) {
+	shutdownOnce.Do(func() { go shutdown(srv, done) })
+}
+
+// Stop accepting requests and wait for those in flight to be answered, which
+// includes waiting on their devices, then stop the timers, disconnect from the
+// brokers and send the last spans. The bridge doesn't push state to Google with
+// Report State, so there is nothing else queued. Closes done when finished.
+func shutdown(srv *http.Server, done chan struct{}) {
+	defer close(done)
+	log.Println("Shutting down")
+	atomic.StoreInt32(&draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v\n", err)
+	}
+	// the timers live in this instance only, their devices stay on
+	for _, home := range homes {
+		home.stopTimers()
+	}
+	DisconnectMQTT()
+	if err := tracer.Flush(); err != nil {
+		log.Printf("Exporting spans failed: %v\n", err)
+	}
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+)
+
+// Setpoints Google may ask for, advertised as thermostatTemperatureRange.
+const (
+	thermostatMinCelsius = 5
+	thermostatMaxCelsius = 35
+)
+
+// Tasmota's ThermostatModeSet values for the modes Google knows: 0 is off and
+// 1 automatic, which heats to TempTargetSet. Manual (2) is shown as heat too.
+// https://tasmota.github.io/docs/Heating-Controller/
+func thermostatModeName(mode int) string {
+	if mode == 0 {
+		return "off"
+	}
+	return "heat"
+}
+
+func thermostatModeValue(name string) (int, bool) {
+	switch name {
+	case "off":
+		return 0, true
+	case "heat":
+		return 1, true
+	}
+	return 0, false
+}
+
+// The form Tasmota's temperatures are compared in, see OneshotRequest.
+func formatTemperature(t float64) string {
+	return strconv.FormatFloat(t, 'f', 1, 64)
+}
+
+// Pick the thermostat state out of a Tasmota message. Telemetry on tele/+/SENSOR
+// and the reply to "Status 10" carry
+// {"DS18B20":{"Temperature":21.3},"Thermostat0":{"ThermostatModeSet":1,"TempTargetSet":22.00,...}}
+// while the replies to our commands are {"ThermostatModeSet1":1} and
+// {"TempTargetSet1":22.5}. What was found is added to values for listeners.
+func parseThermostat(device *TasmotaDevice, jsonMap map[string]interface{}, values map[string]string) {
+	// with several sensors, take the same one every time
+	keys := make([]string, 0, len(jsonMap))
+	for key := range jsonMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sensor := device.Config().TempSensor
+	haveAmbient := false
+
+	for _, key := range keys {
+		switch v := jsonMap[key].(type) {
+		case map[string]interface{}:
+			if key == "Thermostat0" {
+				device.HasThermostat = true
+				if mode, ok := v["ThermostatModeSet"].(float64); ok {
+					device.ThermostatMode = int(mode)
+					values["ThermostatModeSet"] = strconv.Itoa(device.ThermostatMode)
+				}
+				if target, ok := v["TempTargetSet"].(float64); ok {
+					device.TempTarget = target
+					values["TempTargetSet"] = formatTemperature(target)
+				}
+			} else if temperature, ok := v["Temperature"].(float64); ok && !haveAmbient && (sensor == "" || key == sensor) {
+				// the sensor the thermostat measures with
+				device.TempAmbient = temperature
+				values["Temperature"] = formatTemperature(temperature)
+				haveAmbient = true
+			}
+		case float64:
+			if key == "ThermostatModeSet1" {
+				device.ThermostatMode = int(v)
+				values[key] = strconv.Itoa(device.ThermostatMode)
+			} else if key == "TempTargetSet1" {
+				device.TempTarget = v
+				values[key] = formatTemperature(v)
+			}
+		}
+	}
+}
+
+// Whether the device is driven by Tasmota's thermostat, either configured as
+// "type":"thermostat" or seen reporting Thermostat0.
+func (device *TasmotaDevice) IsThermostat() bool {
+	return device.Config().Type == "thermostat" || device.HasThermostat
+}
+
+// https://developers.google.com/assistant/smarthome/traits/temperaturesetting
+type IntentSyncResponseTemperatureRange struct {
+	MinThresholdCelsius float64 `json:"minThresholdCelsius"`
+	MaxThresholdCelsius float64 `json:"maxThresholdCelsius"`
+}
+
+func thermostatAttributes() *IntentSyncResponseAttributes {
+	return &IntentSyncResponseAttributes{
+		AvailableThermostatModes:  []string{"off", "heat"},
+		ThermostatTemperatureUnit: "C",
+		ThermostatTemperatureRange: &IntentSyncResponseTemperatureRange{
+			MinThresholdCelsius: thermostatMinCelsius,
+			MaxThresholdCelsius: thermostatMaxCelsius,
+		},
+	}
+}
+
+// to be called from fulfillment goroutines to switch the first thermostat of
+// the device to a ThermostatModeSet value.
+func (device *TasmotaDevice) SendThermostatMode(ctx context.Context, mode int) {
+	device.sendCommand(ctx, "ThermostatModeSet1", strconv.Itoa(mode))
+}
+
+// to be called from fulfillment goroutines to set the target temperature.
+func (device *TasmotaDevice) SendTempTarget(ctx context.Context, t float64) {
+	device.sendCommand(ctx, "TempTargetSet1", formatTemperature(t))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseThermostat(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		wantMode   int
+		wantTarget float64
+		wantTemp   float64
+		wantValues map[string]string
+	}{
+		{"sensor telemetry", `{"DS18B20":{"Temperature":21.3},"Thermostat0":{"ThermostatModeSet":1,"TempTargetSet":22.00}}`,
+			1, 22, 21.3, map[string]string{"ThermostatModeSet": "1", "TempTargetSet": "22.0", "Temperature": "21.3"}},
+		{"mode reply", `{"ThermostatModeSet1":0}`, 0, 0, 0, map[string]string{"ThermostatModeSet1": "0"}},
+		{"target reply", `{"TempTargetSet1":22.5}`, 0, 22.5, 0, map[string]string{"TempTargetSet1": "22.5"}},
+		{"unrelated", `{"Dimmer":30}`, 0, 0, 0, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d TasmotaDevice
+			var jsonMap map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.payload), &jsonMap); err != nil {
+				t.Fatal(err)
+			}
+			values := make(map[string]string)
+			parseThermostat(&d, jsonMap, values)
+			if d.ThermostatMode != tt.wantMode || d.TempTarget != tt.wantTarget || d.TempAmbient != tt.wantTemp {
+				t.Errorf("mode %d target %v ambient %v", d.ThermostatMode, d.TempTarget, d.TempAmbient)
+			}
+			if len(values) != len(tt.wantValues) {
+				t.Errorf("values %v, want %v", values, tt.wantValues)
+			}
+			for k, v := range tt.wantValues {
+				if values[k] != v {
+					t.Errorf("values[%s] = %q, want %q", k, values[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseThermostatSensors(t *testing.T) {
+	payload := `{"SI7021":{"Temperature":23.1,"Humidity":40.2},"DS18B20":{"Temperature":21.3},` +
+		`"ESP32":{"Temperature":48.9},"Thermostat0":{"ThermostatModeSet":1,"TempTargetSet":22.00}}`
+	tests := []struct {
+		sensor   string
+		wantTemp float64
+	}{
+		// whatever order the map has, the first sensor by name
+		{"", 21.3},
+		{"SI7021", 23.1},
+		{"ESP32", 48.9},
+		{"AM2301", 0},
+	}
+	for _, tt := range tests {
+		home, _ := newTestHome("heater")
+		home.Devices = map[string]DeviceConfig{"heater": {Type: "thermostat", TempSensor: tt.sensor}}
+		d := home.devices["heater"]
+		for i := 0; i < 10; i++ {
+			var jsonMap map[string]interface{}
+			if err := json.Unmarshal([]byte(payload), &jsonMap); err != nil {
+				t.Fatal(err)
+			}
+			parseThermostat(&d, jsonMap, make(map[string]string))
+			if d.TempAmbient != tt.wantTemp {
+				t.Fatalf("tempSensor %q: ambient %v, want %v", tt.sensor, d.TempAmbient, tt.wantTemp)
+			}
+		}
+	}
+}
+
+// A home with a relay on topic "heater" configured as a thermostat.
+func newTestThermostatHome() (*Home, *fakeClient) {
+	home, client := newTestHome("heater")
+	home.Devices = map[string]DeviceConfig{"heater": {Type: "thermostat"}}
+	d := home.devices["heater"]
+	d.ThermostatMode = 1
+	d.TempTarget = 20
+	home.devices["heater"] = d
+	simulateTasmota(home, client)
+	return home, client
+}
+
+func TestThermostatExecute(t *testing.T) {
+	tests := []struct {
+		name          string
+		execution     string
+		wantStates    string
+		wantCode      IntentErrorCode
+		wantPublished string
+	}{
+		{"off", `{"command":"action.devices.commands.ThermostatSetMode","params":{"thermostatMode":"off"}}`,
+			"off 20.0", "", "cmnd/heater/ThermostatModeSet1 0"},
+		{"heat", `{"command":"action.devices.commands.ThermostatSetMode","params":{"thermostatMode":"heat"}}`,
+			"heat 20.0", "", "cmnd/heater/ThermostatModeSet1 1"},
+		{"unknown mode", `{"command":"action.devices.commands.ThermostatSetMode","params":{"thermostatMode":"cool"}}`,
+			"", ErrorValueOutOfRange, ""},
+		{"setpoint", `{"command":"action.devices.commands.ThermostatTemperatureSetpoint",
+			"params":{"thermostatTemperatureSetpoint":22.5}}`, "heat 22.5", "", "cmnd/heater/TempTargetSet1 22.5"},
+		{"setpoint too high", `{"command":"action.devices.commands.ThermostatTemperatureSetpoint",
+			"params":{"thermostatTemperatureSetpoint":40}}`, "", ErrorValueOutOfRange, ""},
+		{"not switched", `{"command":"action.devices.commands.OnOff","params":{"on":true}}`,
+			"", ErrorFunctionNotSupported, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestThermostatHome()
+			data, err := home.GenerateExecuteResponse(context.Background(), executeRequest("heater", tt.execution))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := decodeExecuteResponse(t, data).Payload.Commands[0]
+			if cmd.ErrorCode != tt.wantCode {
+				t.Errorf("errorCode %q, want %q", cmd.ErrorCode, tt.wantCode)
+			}
+			if tt.wantStates != "" {
+				states := cmd.States.ThermostatMode + " " + formatTemperature(cmd.States.ThermostatTemperatureSetpoint)
+				if cmd.States == nil || states != tt.wantStates {
+					t.Errorf("states %q, want %q", states, tt.wantStates)
+				}
+			}
+			if published := strings.Join(client.Published(), ","); published != tt.wantPublished {
+				t.Errorf("published %q, want %q", published, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestThermostatQuery(t *testing.T) {
+	home, client := newTestThermostatHome()
+	var query IntentQueryRequest
+	if err := json.Unmarshal([]byte(`{"requestId":"r1","inputs":[{"intent":"action.devices.QUERY",
+		"payload":{"devices":[{"id":"heater"}]}}]}`), &query); err != nil {
+		t.Fatal(err)
+	}
+	data, err := home.GenerateQueryResponse(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp IntentQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	d := resp.Payload.Devices[0]
+	if d.ThermostatMode != "heat" || d.ThermostatTemperatureSetpoint != 20 || d.ThermostatTemperatureAmbient != 21.5 {
+		t.Errorf("QUERY = %+v", d)
+	}
+	// only sensor status has the thermostat
+	if published := strings.Join(client.Published(), ","); published != "cmnd/heater/Status 10" {
+		t.Errorf("published %q", published)
+	}
+}
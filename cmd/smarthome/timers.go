@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// The longest timer Google may start, advertised as maxTimerLimitSec.
+const maxTimerSec = 24 * 60 * 60
+
+// A countdown started by the Timer trait, after which the relay is switched off,
+// as in "turn off the heater in 30 minutes". It runs in the bridge rather than
+// in Tasmota: PulseTime can't be paused or adjusted, and stays configured on the
+// device for every later power on. The instance has to stay alive until the
+// timer runs out, or it is lost.
+// https://developers.google.com/assistant/smarthome/traits/timer
+type deviceTimer struct {
+	timer     *time.Timer
+	deadline  time.Time
+	remaining time.Duration // while paused
+	paused    bool
+}
+
+// Start the countdown of t, with the device lock held.
+func (home *Home) armTimer(id string, t *deviceTimer, d time.Duration) {
+	var tm *time.Timer
+	tm = time.AfterFunc(d, func() {
+		home.deviceLock.Lock()
+		defer home.deviceLock.Unlock()
+		if home.timers[id] != t || t.timer != tm {
+			// cancelled, paused or adjusted while we waited for the lock
+			return
+		}
+		delete(home.timers, id)
+		device, ok := home.devices[id]
+		if !ok {
+			log.Printf("Timer for %s ran out but the device is gone\n", id)
+			return
+		}
+		log.Printf("Timer for %s ran out, switching it off\n", id)
+		device.SendPowerOnOff(context.Background(), false)
+	})
+	t.timer = tm
+	t.deadline = time.Now().Add(d)
+	t.paused = false
+}
+
+func (home *Home) startTimer(id string, sec int) IntentErrorCode {
+	if sec <= 0 || sec > maxTimerSec {
+		return ErrorValueOutOfRange
+	}
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	d, ok := home.devices[id]
+	if !ok {
+		return ErrorDeviceNotFound
+	}
+	if !d.HasTimer() {
+		return ErrorFunctionNotSupported
+	}
+	if t, ok := home.timers[id]; ok {
+		t.timer.Stop()
+	}
+	t := &deviceTimer{}
+	home.armTimer(id, t, time.Duration(sec)*time.Second)
+	home.timers[id] = t
+	return ""
+}
+
+// Add sec, which may be negative, to the time remaining.
+func (home *Home) adjustTimer(id string, sec int) IntentErrorCode {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	t, ok := home.timers[id]
+	if !ok {
+		return ErrorNoTimerExists
+	}
+	remaining := t.remaining
+	if !t.paused {
+		remaining = time.Until(t.deadline)
+	}
+	remaining += time.Duration(sec) * time.Second
+	if remaining <= 0 || remaining > maxTimerSec*time.Second {
+		return ErrorValueOutOfRange
+	}
+	if t.paused {
+		t.remaining = remaining
+	} else {
+		t.timer.Stop()
+		home.armTimer(id, t, remaining)
+	}
+	return ""
+}
+
+func (home *Home) pauseTimer(id string) IntentErrorCode {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	t, ok := home.timers[id]
+	if !ok {
+		return ErrorNoTimerExists
+	}
+	if !t.paused {
+		t.timer.Stop()
+		t.remaining = time.Until(t.deadline)
+		t.paused = true
+	}
+	return ""
+}
+
+func (home *Home) resumeTimer(id string) IntentErrorCode {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	t, ok := home.timers[id]
+	if !ok {
+		return ErrorNoTimerExists
+	}
+	if t.paused {
+		home.armTimer(id, t, t.remaining)
+	}
+	return ""
+}
+
+func (home *Home) cancelTimer(id string) IntentErrorCode {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	t, ok := home.timers[id]
+	if !ok {
+		return ErrorNoTimerExists
+	}
+	t.timer.Stop()
+	delete(home.timers, id)
+	return ""
+}
+
+// Stop all timers of the home when shutting down, logging each with the time it
+// had left, since nothing will switch its device off.
+func (home *Home) stopTimers() {
+	home.deviceLock.Lock()
+	defer home.deviceLock.Unlock()
+	for id, t := range home.timers {
+		sec, paused := home.timerState(id)
+		t.timer.Stop()
+		delete(home.timers, id)
+		log.Printf("Shutdown cancelled the timer of %s for %q, %ds left, paused %v\n", id, home.User, sec, paused)
+	}
+}
+
+// timerRemainingSec and timerPaused for QUERY and EXECUTE responses, with the
+// device lock held. Google expects -1 when there is no timer.
+func (home *Home) timerState(id string) (int, bool) {
+	t, ok := home.timers[id]
+	if !ok {
+		return -1, false
+	}
+	remaining := t.remaining
+	if !t.paused {
+		remaining = time.Until(t.deadline)
+	}
+	sec := int((remaining + time.Second - 1) / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec, t.paused
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopTimers(t *testing.T) {
+	home, client := newTestHome("heater", "fan")
+	if code := home.startTimer("heater", 60); code != "" {
+		t.Fatal(code)
+	}
+	home.deviceLock.Lock()
+	short := &deviceTimer{}
+	home.armTimer("fan", short, 20*time.Millisecond)
+	home.timers["fan"] = short
+	home.deviceLock.Unlock()
+
+	home.stopTimers()
+	time.Sleep(50 * time.Millisecond)
+	home.deviceLock.Lock()
+	n := len(home.timers)
+	home.deviceLock.Unlock()
+	if n != 0 {
+		t.Errorf("%d timers left", n)
+	}
+	if published := client.Published(); len(published) != 0 {
+		t.Errorf("stopped timer switched %v", published)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+)
+
+// Opens an OAuth token store given the part of OAUTH_TOKEN_STORE after the scheme.
+type TokenStoreOpener func(path string) (oauth2.TokenStore, error)
+
+var tokenStoreLock sync.Mutex
+
+// Token store backends keyed by the scheme of OAUTH_TOKEN_STORE, for example
+// "file:/var/lib/smarthome/tokens.db". The file store is a buntdb database, which
+// survives restarts of a single instance. Sharing tokens between Cloud Run
+// instances needs a database reachable from all of them: implement
+// oauth2.TokenStore for it and call RegisterTokenStore from an init() function.
+var tokenStores = map[string]TokenStoreOpener{
+	"memory": func(path string) (oauth2.TokenStore, error) {
+		return store.NewMemoryTokenStore()
+	},
+	"file": store.NewFileTokenStore,
+}
+
+func RegisterTokenStore(scheme string, opener TokenStoreOpener) {
+	tokenStoreLock.Lock()
+	defer tokenStoreLock.Unlock()
+	tokenStores[scheme] = opener
+}
+
+// Open the token store described by spec, "scheme:path". An empty spec keeps
+// tokens in memory, in which case refresh tokens and pending authorization codes
+// are lost whenever the instance is recycled.
+func OpenTokenStore(spec string) (oauth2.TokenStore, error) {
+	if spec == "" {
+		log.Println("OAUTH_TOKEN_STORE not set, OAuth tokens will not survive a restart")
+		spec = "memory:"
+	}
+
+	scheme, path := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		scheme, path = spec[:i], spec[i+1:]
+	}
+
+	tokenStoreLock.Lock()
+	opener, ok := tokenStores[scheme]
+	tokenStoreLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown OAuth token store %q", scheme)
+	}
+	if scheme == "file" && path == "" {
+		return nil, fmt.Errorf("OAuth file token store needs a path, like file:/data/tokens.db")
+	}
+
+	return opener(path)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry tracing of fulfillment requests: a span for each request, the
+// JWT validation, every MQTT publish and every wait for a device to answer.
+// Spans are exported in batches with OTLP over HTTP, in its JSON encoding, to
+// the collector at OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (to which /v1/traces is appended), with any
+// headers in OTEL_EXPORTER_OTLP_HEADERS as key=value,key=value. Without an
+// endpoint spans are created but dropped.
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type SpanKind int
+
+// As numbered in OTLP.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+	SpanKindProducer SpanKind = 4
+)
+
+type Span struct {
+	TraceId      [16]byte
+	SpanId       [8]byte
+	ParentSpanId [8]byte // all zero for a root span
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string // the span failed if set
+	// Unsampled spans are never exported. Traces we start are sampled, those
+	// continued from a traceparent only if the caller sampled them.
+	Sampled bool
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Where finished spans go.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Batches finished spans for an exporter.
+type Tracer struct {
+	exporter SpanExporter
+	mu       sync.Mutex
+	pending  []*Span
+	flushCh  chan struct{}
+}
+
+const (
+	traceBatchSize     = 256
+	traceMaxQueue      = 4096
+	traceFlushInterval = 5 * time.Second
+)
+
+var tracer = &Tracer{flushCh: make(chan struct{}, 1)}
+
+// Export to the OTLP endpoint in the environment, if any, from now on.
+func SetupTracing() {
+	endpoint := settings.OTLPTracesEndpoint
+	if endpoint == "" {
+		if base := settings.OTLPEndpoint; base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	exporter := &OTLPExporter{
+		Endpoint:    endpoint,
+		Headers:     make(map[string]string),
+		ServiceName: settings.ServiceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, kv := range strings.Split(settings.OTLPHeaders, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			exporter.Headers[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+	if exporter.ServiceName == "" {
+		exporter.ServiceName = "g_assist_mqtt"
+	}
+	tracer.SetExporter(exporter)
+	go tracer.run()
+	logger.Info("Exporting traces", "endpoint", endpoint)
+}
+
+func (t *Tracer) SetExporter(exporter SpanExporter) {
+	t.mu.Lock()
+	t.exporter = exporter
+	t.mu.Unlock()
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flushCh:
+		}
+		if err := t.Flush(); err != nil {
+			logger.Warn("Exporting spans failed", "error", err)
+		}
+	}
+}
+
+// Export the spans finished so far.
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	exporter := t.exporter
+	t.mu.Unlock()
+	if exporter == nil || len(spans) == 0 {
+		return nil
+	}
+	return exporter.ExportSpans(spans)
+}
+
+func (t *Tracer) finish(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exporter == nil || !s.Sampled || len(t.pending) >= traceMaxQueue {
+		return
+	}
+	t.pending = append(t.pending, s)
+	if len(t.pending) >= traceBatchSize {
+		select {
+		case t.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type spanContextKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// Start a span, the child of the span in ctx if there is one. Attributes are
+// given as alternating keys and values.
+func StartSpan(ctx context.Context, name string, kind SpanKind, kv ...interface{}) (context.Context, *Span) {
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]interface{}), Sampled: true}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceId = parent.TraceId
+		s.ParentSpanId = parent.SpanId
+		s.Sampled = parent.Sampled
+	} else {
+		rand.Read(s.TraceId[:])
+	}
+	rand.Read(s.SpanId[:])
+	s.SetAttributes(kv...)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// Start a server span for an HTTP request, continuing the trace in a W3C
+// traceparent header if the caller sent a valid one.
+func StartServerSpan(r *http.Request, name string, kv ...interface{}) (context.Context, *Span) {
+	ctx, s := StartSpan(r.Context(), name, SpanKindServer, kv...)
+	if traceId, parentId, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.TraceId = traceId
+		s.ParentSpanId = parentId
+		s.Sampled = sampled
+	}
+	return ctx, s
+}
+
+// Parse traceparent: <version>-<32 hex trace id>-<16 hex parent id>-<flags>,
+// where bit 0 of the flags is whether the caller sampled the trace. Version ff
+// and all-zero ids are invalid, the trace is started afresh for those.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceparent(header string) (traceId [16]byte, parentId [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	for _, part := range parts {
+		// only lower case hex is allowed
+		if strings.Trim(part, "0123456789abcdef") != "" {
+			return
+		}
+	}
+	if parts[0] == "ff" {
+		return
+	}
+	hex.Decode(traceId[:], []byte(parts[1]))
+	hex.Decode(parentId[:], []byte(parts[2]))
+	if traceId == [16]byte{} || parentId == [8]byte{} {
+		return
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return traceId, parentId, flags[0]&1 != 0, true
+}
+
+// A span for publishing an MQTT message, finished once the broker has it.
+func startPublishSpan(ctx context.Context, topic string) *Span {
+	_, span := StartSpan(ctx, "mqtt.publish", SpanKindProducer, "messaging.system", "mqtt",
+		"messaging.destination", topic)
+	return span
+}
+
+func (s *Span) SetAttributes(kv ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.Attributes[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+}
+
+func (s *Span) SetError(msg string) {
+	s.mu.Lock()
+	s.Error = msg
+	s.mu.Unlock()
+}
+
+func (s *Span) TraceIdString() string {
+	return hex.EncodeToString(s.TraceId[:])
+}
+
+// Finish the span and queue it for export. Only the first call has an effect.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	tracer.finish(s)
+}
+
+// Keeps spans in memory, for tests and debugging.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *InMemoryExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Sends spans to an OpenTelemetry collector with OTLP/HTTP in JSON.
+type OTLPExporter struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+	client      *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 are strings in JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"` // hex, unlike other bytes
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributeOf(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+// The ExportTraceServiceRequest of OTLP.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{otlpAttributeOf("service.name", e.ServiceName)}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/DentonGentry/g_assist_mqtt"
+
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceId:           hex.EncodeToString(s.TraceId[:]),
+			SpanId:            hex.EncodeToString(s.SpanId[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentSpanId != [8]byte{} {
+			span.ParentSpanId = hex.EncodeToString(s.ParentSpanId[:])
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttributeOf(k, v))
+		}
+		if s.Error != "" {
+			span.Status.Code = 2
+			span.Status.Message = s.Error
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, span)
+	}
+
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.Endpoint, resp.Status)
+	}
+	return nil
+}
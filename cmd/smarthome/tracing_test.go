@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Export spans to memory for the rest of the test.
+func setupTestTracing(t *testing.T) *InMemoryExporter {
+	t.Helper()
+	exporter := &InMemoryExporter{}
+	tracer.Flush()
+	tracer.SetExporter(exporter)
+	t.Cleanup(func() {
+		tracer.SetExporter(nil)
+		tracer.Flush()
+	})
+	return exporter
+}
+
+// Flush the tracer until n spans have been exported, or a second has passed.
+func exportedSpans(t *testing.T, exporter *InMemoryExporter, n int) []*Span {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := tracer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		spans := exporter.Spans()
+		if len(spans) >= n || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFulfillmentSpans(t *testing.T) {
+	const callerTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const callerSpan = "00f067aa0ba902b7"
+	tests := []struct {
+		name        string
+		traceparent string
+		wantTrace   string // "" for a new one
+		wantParent  string // of the fulfillment span
+		wantSpans   bool
+	}{
+		{"new trace", "", "", "0000000000000000", true},
+		{"sampled caller", "00-" + callerTrace + "-" + callerSpan + "-01", callerTrace, callerSpan, true},
+		{"unsampled caller", "00-" + callerTrace + "-" + callerSpan + "-00", "", "", false},
+		{"malformed", "00-" + callerTrace + "-" + callerSpan, "", "0000000000000000", true},
+		{"invalid version", "ff-" + callerTrace + "-" + callerSpan + "-01", "", "0000000000000000", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, client := newTestHome("relay")
+			simulateTasmota(home, client)
+			token := setupTestFulfillment(t, home)
+			exporter := setupTestTracing(t)
+
+			body := `{"requestId":"r1","inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[
+				{"devices":[{"id":"relay"}],"execution":[{"command":"action.devices.commands.OnOff","params":{"on":true}}]}]}}]}`
+			r := httptest.NewRequest("POST", "/fulfillment", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+token)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			w := httptest.NewRecorder()
+			HandleFulfillment(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			// the publish span ends once the broker has the message, which may
+			// be after the response
+			spans := exportedSpans(t, exporter, 4)
+			if !tt.wantSpans {
+				if len(spans) != 0 {
+					t.Errorf("%d spans exported, want none", len(spans))
+				}
+				return
+			}
+			byName := make(map[string]*Span)
+			var names []string
+			for _, s := range spans {
+				byName[s.Name] = s
+				names = append(names, s.Name)
+			}
+			sort.Strings(names)
+			if got := strings.Join(names, ","); got != "device.wait,fulfillment,mqtt.publish,validate_jwt" {
+				t.Fatalf("spans %s", got)
+			}
+
+			root := byName["fulfillment"]
+			if root.Kind != SpanKindServer || root.Attributes["intent"] != "EXECUTE" || root.Error != "" {
+				t.Errorf("fulfillment span %+v", root)
+			}
+			if got := hex.EncodeToString(root.ParentSpanId[:]); got != tt.wantParent {
+				t.Errorf("fulfillment parent %s, want %s", got, tt.wantParent)
+			}
+			if tt.wantTrace != "" && root.TraceIdString() != tt.wantTrace {
+				t.Errorf("trace %s, want %s", root.TraceIdString(), tt.wantTrace)
+			}
+			if tt.wantTrace == "" && (root.TraceIdString() == callerTrace || root.TraceId == [16]byte{}) {
+				t.Errorf("trace %s continued, want a new one", root.TraceIdString())
+			}
+			for _, name := range []string{"validate_jwt", "device.wait", "mqtt.publish"} {
+				s := byName[name]
+				if s.TraceId != root.TraceId || s.ParentSpanId != root.SpanId {
+					t.Errorf("%s is not a child of the fulfillment span", name)
+				}
+			}
+			if wait := byName["device.wait"]; wait.Attributes["device"] != "relay" || wait.Attributes["timedOut"] != nil {
+				t.Errorf("device.wait attributes %v", wait.Attributes)
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parent = "00f067aa0ba902b7"
+	tests := []struct {
+		name        string
+		header      string
+		wantOk      bool
+		wantSampled bool
+	}{
+		{"sampled", "00-" + trace + "-" + parent + "-01", true, true},
+		{"unsampled", "00-" + trace + "-" + parent + "-00", true, false},
+		{"other flags", "00-" + trace + "-" + parent + "-03", true, true},
+		{"future version", "01-" + trace + "-" + parent + "-01", true, true},
+		{"empty", "", false, false},
+		{"version ff", "ff-" + trace + "-" + parent + "-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + parent + "-01", false, false},
+		{"zero parent id", "00-" + trace + "-0000000000000000-01", false, false},
+		{"upper case", "00-" + strings.ToUpper(trace) + "-" + parent + "-01", false, false},
+		{"not hex", "00-" + trace + "-" + parent + "-0x", false, false},
+		{"short trace id", "00-" + trace[2:] + "-" + parent + "-01", false, false},
+		{"extra field", "00-" + trace + "-" + parent + "-01-00", false, false},
+	}
+	for _, tt := range tests {
+		traceId, parentId, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.wantOk || sampled != tt.wantSampled {
+			t.Errorf("%s: ok %v sampled %v, want %v %v", tt.name, ok, sampled, tt.wantOk, tt.wantSampled)
+		}
+		if ok && (hex.EncodeToString(traceId[:]) != trace || hex.EncodeToString(parentId[:]) != parent) {
+			t.Errorf("%s: trace %x parent %x", tt.name, traceId, parentId)
+		}
+	}
+}
+
+// The ExportTraceServiceRequest in the JSON encoding of OTLP, from
+// opentelemetry-proto's trace/v1/trace.proto and common/v1/common.proto, with
+// only the fields the exporter may send. Anything else fails to decode.
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTestAnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *json.RawMessage `json:"intValue"` // int64, so a string
+	DoubleValue *float64         `json:"doubleValue"`
+}
+
+type otlpTestKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpTestAnyValue `json:"value"`
+}
+
+type otlpTestRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpTestKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []struct {
+				TraceId           string             `json:"traceId"`
+				SpanId            string             `json:"spanId"`
+				ParentSpanId      *string            `json:"parentSpanId"`
+				Name              string             `json:"name"`
+				Kind              int                `json:"kind"`
+				StartTimeUnixNano string             `json:"startTimeUnixNano"`
+				EndTimeUnixNano   string             `json:"endTimeUnixNano"`
+				Attributes        []otlpTestKeyValue `json:"attributes"`
+				Status            struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// The attribute as a Go value, checking that it has exactly one value set.
+func otlpTestValue(t *testing.T, kv otlpTestKeyValue) interface{} {
+	t.Helper()
+	var values []interface{}
+	if v := kv.Value.StringValue; v != nil {
+		values = append(values, *v)
+	}
+	if v := kv.Value.BoolValue; v != nil {
+		values = append(values, *v)
+	}
+	if v := kv.Value.IntValue; v != nil {
+		var s string
+		if err := json.Unmarshal(*v, &s); err != nil {
+			t.Errorf("attribute %s: intValue %s is not a string", kv.Key, *v)
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			t.Errorf("attribute %s: intValue %q", kv.Key, s)
+		}
+		values = append(values, n)
+	}
+	if v := kv.Value.DoubleValue; v != nil {
+		values = append(values, *v)
+	}
+	if len(values) != 1 {
+		t.Errorf("attribute %s has %d values", kv.Key, len(values))
+		return nil
+	}
+	return values[0]
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var header http.Header
+	var method string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, header = r.Method, r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+	exporter := &OTLPExporter{
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+		ServiceName: "smarthome-test",
+		client:      collector.Client(),
+	}
+
+	ctx, root := StartSpan(context.Background(), "fulfillment", SpanKindServer)
+	root.SetAttributes("intent", "QUERY", "devices", 2, "latency", 0.25, "cached", false)
+	root.End = root.Start.Add(3 * time.Millisecond)
+	_, child := StartSpan(ctx, "device.wait", SpanKindInternal)
+	child.SetError("timed out")
+	child.End = child.Start.Add(time.Millisecond)
+	if err := exporter.ExportSpans([]*Span{root, child}); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPost || header.Get("Content-Type") != "application/json" ||
+		header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("%s with headers %v", method, header)
+	}
+	var req otlpTestRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("not one resource with one scope: %s", body)
+	}
+	rs := req.ResourceSpans[0]
+	resource := make(map[string]interface{})
+	for _, kv := range rs.Resource.Attributes {
+		resource[kv.Key] = otlpTestValue(t, kv)
+	}
+	if resource["service.name"] != "smarthome-test" {
+		t.Errorf("resource attributes %v", resource)
+	}
+	if rs.ScopeSpans[0].Scope.Name == "" {
+		t.Errorf("scope without a name")
+	}
+
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	traceId := regexp.MustCompile("^[0-9a-f]{32}$")
+	spanId := regexp.MustCompile("^[0-9a-f]{16}$")
+	for _, s := range spans {
+		if !traceId.MatchString(s.TraceId) || !spanId.MatchString(s.SpanId) {
+			t.Errorf("%s: trace id %q span id %q", s.Name, s.TraceId, s.SpanId)
+		}
+		if s.TraceId != root.TraceIdString() {
+			t.Errorf("%s: trace id %s, want %s", s.Name, s.TraceId, root.TraceIdString())
+		}
+		if s.ParentSpanId != nil && !spanId.MatchString(*s.ParentSpanId) {
+			t.Errorf("%s: parent span id %q", s.Name, *s.ParentSpanId)
+		}
+		if s.Kind < 1 || s.Kind > 5 {
+			t.Errorf("%s: kind %d", s.Name, s.Kind)
+		}
+		start, err1 := strconv.ParseUint(s.StartTimeUnixNano, 10, 64)
+		end, err2 := strconv.ParseUint(s.EndTimeUnixNano, 10, 64)
+		if err1 != nil || err2 != nil || start == 0 || end < start {
+			t.Errorf("%s: start %q end %q", s.Name, s.StartTimeUnixNano, s.EndTimeUnixNano)
+		}
+		if s.Status.Code < 0 || s.Status.Code > 2 {
+			t.Errorf("%s: status code %d", s.Name, s.Status.Code)
+		}
+	}
+
+	r, c := spans[0], spans[1]
+	if r.Name != "fulfillment" || r.Kind != 2 || r.ParentSpanId != nil || r.Status.Code != 0 {
+		t.Errorf("root span %+v", r)
+	}
+	if r.SpanId != hex.EncodeToString(root.SpanId[:]) {
+		t.Errorf("root span id %s", r.SpanId)
+	}
+	attributes := make(map[string]interface{})
+	for _, kv := range r.Attributes {
+		attributes[kv.Key] = otlpTestValue(t, kv)
+	}
+	want := map[string]interface{}{"intent": "QUERY", "devices": int64(2), "latency": 0.25, "cached": false}
+	for k, v := range want {
+		if attributes[k] != v {
+			t.Errorf("attribute %s = %#v, want %#v", k, attributes[k], v)
+		}
+	}
+	if c.Name != "device.wait" || c.Kind != 1 || c.ParentSpanId == nil || *c.ParentSpanId != r.SpanId ||
+		c.Status.Code != 2 || c.Status.Message != "timed out" {
+		t.Errorf("child span %+v", c)
+	}
+}
+
+// A device not answering ends its wait span with an error.
+func TestDeviceWaitSpanTimeout(t *testing.T) {
+	home, _ := newTestHome("dead")
+	token := setupTestFulfillment(t, home)
+	exporter := setupTestTracing(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fulfill(t, ctx, token, `{"requestId":"r1","inputs":[{"intent":"action.devices.QUERY",
+		"payload":{"devices":[{"id":"dead"}]}}]}`)
+	tracer.Flush()
+	for _, s := range exporter.Spans() {
+		if s.Name == "device.wait" {
+			if s.Attributes["timedOut"] != true || s.Error == "" {
+				t.Errorf("device.wait span %+v", s)
+			}
+			return
+		}
+	}
+	t.Errorf("no device.wait span")
+}
@@ -9,8 +9,9 @@ require (
 	github.com/golang/protobuf v1.5.1 // indirect
 	github.com/google/uuid v1.2.0 // indirect
 	github.com/tidwall/btree v0.4.2 // indirect
-	github.com/tidwall/buntdb v1.2.0 // indirect
+	github.com/tidwall/buntdb v1.2.0
 	github.com/tidwall/pretty v1.1.0 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4 // indirect
 	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
 	golang.org/x/text v0.3.5 // indirect